@@ -0,0 +1,213 @@
+package webutil
+
+import (
+	"context"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminTokenAuthenticatedKey = "webutil:admin:tokenAuthenticated"
+
+type AdminConfig struct {
+	Disabled        bool          `env:"DISABLED" long:"disabled" description:"Disable the admin server"`
+	Host            string        `env:"HOST" value-name:"ADDRESS" long:"host" description:"Address for the admin server to listen on (only loopback addresses are allowed unless authentication is configured)" default:"127.0.0.1"`
+	Port            int           `env:"PORT" value-name:"PORT" long:"port" description:"Port for the admin server to listen on (must differ from the public port)" default:"8001"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" value-name:"DURATION" long:"shutdown-timeout" description:"How long to wait for in-flight admin requests when shutting down" default:"5s"`
+	Token           string        `env:"TOKEN" value-name:"TOKEN" long:"token" description:"Static bearer token granting access to the admin endpoints" secret:"true"`
+	RequiredScope   string        `env:"REQUIRED_SCOPE" value-name:"SCOPE" long:"required-scope" description:"Scope a JWT must carry to access the admin endpoints (when a JWT middleware is provided)" default:"admin"`
+
+	// authenticated is set by NewAdminGin when it protects the admin endpoints with a token or a JWT middleware
+	authenticated bool
+}
+
+func (c *AdminConfig) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid admin port %d", c.Port))
+	}
+	return nil
+}
+
+// Serve serves the given admin handler (see NewAdminGin) until the given context is done, unless disabled. Admin
+// servers without authentication are refused unless they listen on a loopback address.
+func (c *AdminConfig) Serve(ctx context.Context, handler http.Handler) error {
+	if c.Disabled {
+		return nil
+	} else if !c.authenticated && !isLoopbackHost(c.Host) {
+		return errors.NewWithStackTrace(fmt.Sprintf("admin server without authentication must listen on a loopback address, not '%s'", c.Host))
+	}
+
+	config := &HTTPConfig{Port: c.Port, ShutdownTimeout: c.ShutdownTimeout}
+	server, err := config.NewServer(ctx, handler)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	server.Addr = addr
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Chain(err, "failed listening on '%s'", addr)
+	}
+	return config.serve(ctx, server, listener)
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type adminSettings struct {
+	jwtMiddleware gin.HandlerFunc
+}
+
+type AdminOption func(*adminSettings)
+
+// WithAdminJWTMiddleware allows requests authenticated by the given JWT middleware (e.g. one created by
+// CreateAuth0JWTValidationGinMiddleware) whose claims carry the configured required scope.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAdminJWTMiddleware(middleware gin.HandlerFunc) AdminOption {
+	return func(s *adminSettings) { s.jwtMiddleware = middleware }
+}
+
+// NewAdminGin creates a gin engine exposing administrative & debugging endpoints for the given public engine, meant to
+// be served on a separate, non-public listener (see AdminConfig.Serve). If a token or a JWT middleware is configured,
+// all endpoints require authentication; otherwise they are unprotected, and may only be served on a loopback address.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewAdminGin(config *AdminConfig, public *gin.Engine, options ...AdminOption) *gin.Engine {
+	settings := &adminSettings{}
+	for _, option := range options {
+		option(settings)
+	}
+	config.authenticated = config.Token != "" || settings.jwtMiddleware != nil
+
+	router := NewGin()
+	admin := router.Group("/", settings.authenticate(config))
+	if settings.jwtMiddleware != nil {
+		admin.Use(settings.authorize(config))
+	}
+	admin.GET("/debug/pprof/*profile", ginPProfHandler)
+	admin.POST("/debug/pprof/*profile", ginPProfHandler)
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	admin.GET("/buildinfo", ginBuildInfoHandler)
+	admin.GET("/routes", func(c *gin.Context) {
+		routes := make([]map[string]string, 0)
+		for _, route := range public.Routes() {
+			routes = append(routes, map[string]string{"method": route.Method, "path": route.Path, "handler": route.Handler})
+		}
+		c.JSON(http.StatusOK, routes)
+	})
+	admin.GET("/loglevel", ginGetLogLevelHandler)
+	admin.PUT("/loglevel", ginSetLogLevelHandler)
+	return router
+}
+
+func (s *adminSettings) authenticate(config *AdminConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.Token != "" {
+			authorization := c.GetHeader("Authorization")
+			if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) == 1 {
+					c.Set(adminTokenAuthenticatedKey, true)
+					c.Next()
+					return
+				}
+			}
+		}
+		if s.jwtMiddleware != nil {
+			s.jwtMiddleware(c)
+		} else if config.Token != "" {
+			AbortWithErrorResponse(c, http.StatusUnauthorized, "UNAUTHORIZED", "A valid admin token is required")
+		}
+	}
+}
+
+func (s *adminSettings) authorize(config *AdminConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetBool(adminTokenAuthenticatedKey) {
+			return
+		} else if GetClaims(c.Request.Context()) == nil {
+			AbortWithErrorResponse(c, http.StatusUnauthorized, "UNAUTHORIZED", "Authentication is required")
+		} else if config.RequiredScope != "" && !HasClaimsScope(c.Request.Context(), config.RequiredScope) {
+			AbortWithErrorResponse(c, http.StatusForbidden, "FORBIDDEN", fmt.Sprintf("Scope '%s' is required", config.RequiredScope))
+		}
+	}
+}
+
+func ginPProfHandler(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+func ginBuildInfoHandler(c *gin.Context) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		AbortWithErrorResponse(c, http.StatusNotFound, "BUILD_INFO_UNAVAILABLE", "Build information is not available")
+		return
+	}
+	settings := make(map[string]string)
+	for _, setting := range info.Settings {
+		settings[setting.Key] = setting.Value
+	}
+	deps := make([]map[string]string, 0, len(info.Deps))
+	for _, dep := range info.Deps {
+		deps = append(deps, map[string]string{"path": dep.Path, "version": dep.Version, "sum": dep.Sum})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"goVersion": info.GoVersion,
+		"path":      info.Path,
+		"main":      map[string]string{"path": info.Main.Path, "version": info.Main.Version, "sum": info.Main.Sum},
+		"settings":  settings,
+		"deps":      deps,
+	})
+}
+
+type logLevelRequest struct {
+	Level string `json:"level" binding:"required"`
+}
+
+func ginGetLogLevelHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, logLevelRequest{Level: LogLevel().String()})
+}
+
+func ginSetLogLevelHandler(c *gin.Context) {
+	var req logLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		AbortWithErrorResponse(c, http.StatusBadRequest, "INVALID_REQUEST", "Request body must be a JSON object with a 'level' property")
+		return
+	}
+	level, err := zerolog.ParseLevel(strings.ToLower(req.Level))
+	if err != nil || req.Level == "" {
+		AbortWithErrorResponse(c, http.StatusBadRequest, "INVALID_LOG_LEVEL", fmt.Sprintf("Unknown log level '%s'", req.Level))
+		return
+	}
+	previous := LogLevel()
+	SetLogLevel(level)
+	log.Ctx(c.Request.Context()).Info().Str("previous", previous.String()).Str("level", level.String()).Msg("Log level changed")
+	c.JSON(http.StatusOK, logLevelRequest{Level: level.String()})
+}
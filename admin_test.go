@@ -0,0 +1,139 @@
+package webutil
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testScopedClaims struct {
+	Scope string `json:"scope"`
+}
+
+func (c *testScopedClaims) Validate(context.Context) error { return nil }
+
+func (c *testScopedClaims) HasScope(expectedScope string) bool {
+	return HasScope(c.Scope, expectedScope)
+}
+
+func TestAdminGin(t *testing.T) {
+	public := gin.New()
+	public.GET("/items/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	// Fake JWT middleware: the bearer token is the scope string of the caller
+	jwtMiddleware := func(c *gin.Context) {
+		scope, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer jwt:")
+		if !ok {
+			_ = c.AbortWithError(http.StatusUnauthorized, http.ErrNoCookie)
+			return
+		}
+		claims := &validator.ValidatedClaims{CustomClaims: &testScopedClaims{Scope: scope}}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), jwtmiddleware.ContextKey{}, claims))
+		c.Next()
+	}
+	config := &AdminConfig{Port: 8001, Token: "s3cr3t", RequiredScope: "admin"}
+	admin := NewAdminGin(config, public, WithAdminJWTMiddleware(jwtMiddleware))
+
+	request := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("authentication", func(t *testing.T) {
+		testCases := map[string]struct {
+			authorization  string
+			expectedStatus int
+		}{
+			"missing":           {authorization: "", expectedStatus: http.StatusUnauthorized},
+			"wrong token":       {authorization: "Bearer wrong", expectedStatus: http.StatusUnauthorized},
+			"static token":      {authorization: "Bearer s3cr3t", expectedStatus: http.StatusOK},
+			"jwt without scope": {authorization: "Bearer jwt:read write", expectedStatus: http.StatusForbidden},
+			"jwt with scope":    {authorization: "Bearer jwt:read admin", expectedStatus: http.StatusOK},
+		}
+		for name, tc := range testCases {
+			tc := tc
+			t.Run(name, func(t *testing.T) {
+				if rec := request(http.MethodGet, "/debug/vars", tc.authorization, ""); rec.Code != tc.expectedStatus {
+					t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/goroutine?debug=1", "/debug/vars", "/buildinfo"} {
+			if rec := request(http.MethodGet, path, "Bearer s3cr3t", ""); rec.Code != http.StatusOK {
+				t.Errorf("Expected '%s' to return 200, got %d: %s", path, rec.Code, rec.Body.String())
+			}
+		}
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		rec := request(http.MethodGet, "/routes", "Bearer s3cr3t", "")
+		var routes []map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil {
+			t.Fatalf("Failed unmarshalling routes: %+v", err)
+		} else if len(routes) != 1 || routes[0]["method"] != http.MethodGet || routes[0]["path"] != "/items/:id" {
+			t.Errorf("Expected public routes only, got: %+v", routes)
+		}
+	})
+
+	t.Run("log level", func(t *testing.T) {
+		original := zerolog.GlobalLevel()
+		defer zerolog.SetGlobalLevel(original)
+
+		if rec := request(http.MethodPut, "/loglevel", "Bearer s3cr3t", `{"level":"verbose"}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected unknown level to be rejected, got %d", rec.Code)
+		}
+		if rec := request(http.MethodPut, "/loglevel", "Bearer s3cr3t", `{"level":"WARN"}`); rec.Code != http.StatusOK {
+			t.Errorf("Expected level change to succeed, got %d: %s", rec.Code, rec.Body.String())
+		} else if zerolog.GlobalLevel() != zerolog.WarnLevel {
+			t.Errorf("Expected global level to be warn, got %s", zerolog.GlobalLevel())
+		}
+		if rec := request(http.MethodGet, "/loglevel", "Bearer s3cr3t", ""); !strings.Contains(rec.Body.String(), `"warn"`) {
+			t.Errorf("Expected current level to be reported, got: %s", rec.Body.String())
+		}
+	})
+}
+
+func TestAdminConfigServeRequiresAuthenticationOnPublicAddresses(t *testing.T) {
+	testCases := map[string]struct {
+		config        AdminConfig
+		options       []AdminOption
+		expectRefusal bool
+	}{
+		"unauthenticated on loopback":  {config: AdminConfig{Host: "127.0.0.1"}},
+		"unauthenticated on localhost": {config: AdminConfig{Host: "localhost"}},
+		"unauthenticated on all":       {config: AdminConfig{Host: ""}, expectRefusal: true},
+		"unauthenticated on public":    {config: AdminConfig{Host: "0.0.0.0"}, expectRefusal: true},
+		"token on public":              {config: AdminConfig{Host: "0.0.0.0", Token: "s3cr3t"}},
+		"jwt middleware on public":     {config: AdminConfig{Host: "0.0.0.0"}, options: []AdminOption{WithAdminJWTMiddleware(func(c *gin.Context) { c.Next() })}},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			handler := NewAdminGin(&tc.config, gin.New(), tc.options...)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := tc.config.Serve(ctx, handler)
+			if tc.expectRefusal && (err == nil || !strings.Contains(err.Error(), "loopback address")) {
+				t.Errorf("Expected the admin server to be refused, got: %v", err)
+			} else if !tc.expectRefusal && err != nil {
+				t.Errorf("Expected the admin server to start, got: %+v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package webutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultAPIKeyHeader = "X-API-Key"
+
+// APIKeyPrincipal is the principal an API key authenticates as.
+type APIKeyPrincipal struct {
+	Subject string
+	Scopes  []string
+}
+
+// KeyStore resolves API keys to the principals they authenticate as. Implementations must compare keys in constant
+// time, and return a nil principal (and no error) for unknown keys.
+type KeyStore interface {
+	Lookup(ctx context.Context, key string) (*APIKeyPrincipal, error)
+}
+
+type apiKeyEntry struct {
+	hash      [sha256.Size]byte
+	principal *APIKeyPrincipal
+}
+
+// lookupAPIKey finds the entry matching the given key by comparing its hash with the hash of every entry, in constant
+// time, so that neither the key nor its position in the store leaks through response timing.
+func lookupAPIKey(entries []apiKeyEntry, key string) *APIKeyPrincipal {
+	hash := sha256.Sum256([]byte(key))
+	var principal *APIKeyPrincipal
+	for i := range entries {
+		if subtle.ConstantTimeCompare(entries[i].hash[:], hash[:]) == 1 {
+			principal = entries[i].principal
+		}
+	}
+	return principal
+}
+
+// MemoryKeyStore is a KeyStore of API keys given in code, e.g. from configuration.
+type MemoryKeyStore struct {
+	entries []apiKeyEntry
+}
+
+// NewMemoryKeyStore creates a KeyStore of the given API keys & the principals they authenticate as.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewMemoryKeyStore(keys map[string]APIKeyPrincipal) *MemoryKeyStore {
+	store := &MemoryKeyStore{entries: make([]apiKeyEntry, 0, len(keys))}
+	for key, principal := range keys {
+		principal := principal
+		store.entries = append(store.entries, apiKeyEntry{hash: sha256.Sum256([]byte(key)), principal: &principal})
+	}
+	return store
+}
+
+func (s *MemoryKeyStore) Lookup(_ context.Context, key string) (*APIKeyPrincipal, error) {
+	return lookupAPIKey(s.entries, key), nil
+}
+
+// HashedFileKeyStore is a KeyStore of API keys read from a file holding only their SHA-256 hashes, so that the file
+// does not need to be kept secret. Each line of the file is of the form "<hex SHA-256 of key> <subject> [scope...]";
+// empty lines & lines starting with "#" are ignored.
+type HashedFileKeyStore struct {
+	path    string
+	entries atomic.Pointer[[]apiKeyEntry]
+}
+
+// NewHashedFileKeyStore creates a KeyStore of the API keys in the given file (see HashedFileKeyStore).
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewHashedFileKeyStore(path string) (*HashedFileKeyStore, error) {
+	store := &HashedFileKeyStore{path: path}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *HashedFileKeyStore) Lookup(_ context.Context, key string) (*APIKeyPrincipal, error) {
+	return lookupAPIKey(*s.entries.Load(), key), nil
+}
+
+// Reload re-reads the file, and swaps its keys in if successful. Invalid files are rejected and logged, and the
+// current keys remain in effect.
+func (s *HashedFileKeyStore) Reload() error {
+	if err := s.load(); err != nil {
+		log.Error().Stack().Err(err).Str("path", s.path).Msg("API keys reload rejected")
+		return err
+	}
+	log.Info().Str("path", s.path).Msg("API keys reloaded")
+	return nil
+}
+
+// WatchFile reloads the keys whenever the file changes, until the given context is done.
+func (s *HashedFileKeyStore) WatchFile(ctx context.Context) error {
+	return watchFiles(ctx, func() { _ = s.Reload() }, s.path)
+}
+
+func (s *HashedFileKeyStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return errors.Chain(err, "failed opening API keys file '%s'", s.path)
+	}
+	defer f.Close()
+
+	var entries []apiKeyEntry
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return errors.NewWithStackTrace(fmt.Sprintf("invalid API key at line %d of '%s': subject is missing", lineNumber, s.path))
+		}
+		hash, err := hex.DecodeString(fields[0])
+		if err != nil || len(hash) != sha256.Size {
+			return errors.NewWithStackTrace(fmt.Sprintf("invalid API key at line %d of '%s': not a hex SHA-256 hash", lineNumber, s.path))
+		}
+		entry := apiKeyEntry{principal: &APIKeyPrincipal{Subject: fields[1], Scopes: fields[2:]}}
+		copy(entry.hash[:], hash)
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Chain(err, "failed reading API keys file '%s'", s.path)
+	}
+	s.entries.Store(&entries)
+	return nil
+}
+
+type apiKeySettings struct {
+	header         string
+	queryParameter string
+	optional       bool
+}
+
+type APIKeyOption func(*apiKeySettings)
+
+// WithAPIKeyHeader makes the API key middleware read keys from the given header instead of "X-API-Key". The header is
+// redacted in access logs (see RedactAccessLogHeader).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAPIKeyHeader(name string) APIKeyOption {
+	return func(s *apiKeySettings) { s.header = name }
+}
+
+// WithAPIKeyQueryParameter makes the API key middleware also read keys from the given query parameter, for clients
+// that cannot send headers. The parameter is redacted in access logs (see RedactAccessLogQueryParameter).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAPIKeyQueryParameter(name string) APIKeyOption {
+	return func(s *apiKeySettings) { s.queryParameter = name }
+}
+
+// WithOptionalAPIKeyAuthentication makes the API key middleware let requests without a key through anonymously (see
+// IsAuthenticated). Requests with unknown keys are still rejected.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithOptionalAPIKeyAuthentication() APIKeyOption {
+	return func(s *apiKeySettings) { s.optional = true }
+}
+
+// CreateAPIKeyGinMiddleware creates a middleware authenticating requests by API keys resolved by the given store. The
+// principal is exposed the same way as by the JWT middleware, with its subject in the registered claims and its scopes
+// in OIDCClaims custom claims, so GetClaims, GetCustomClaims & HasClaimsScope work regardless of the scheme used.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateAPIKeyGinMiddleware(store KeyStore, options ...APIKeyOption) func(c *gin.Context) {
+	settings := &apiKeySettings{header: defaultAPIKeyHeader}
+	for _, option := range options {
+		option(settings)
+	}
+	RedactAccessLogHeader(settings.header)
+	challenge := fmt.Sprintf(`APIKey header="%s"`, settings.header)
+	if settings.queryParameter != "" {
+		RedactAccessLogQueryParameter(settings.queryParameter)
+		challenge += fmt.Sprintf(`, query="%s"`, settings.queryParameter)
+	}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(settings.header)
+		if key == "" && settings.queryParameter != "" {
+			key = c.Query(settings.queryParameter)
+		}
+		if key == "" {
+			if settings.optional {
+				c.Next()
+			} else {
+				abortWithAPIKeyError(c, http.StatusUnauthorized, challenge, "missing_api_key", "An API key is required", errors.New("API key is missing"))
+			}
+			return
+		}
+
+		ctx := c.Request.Context()
+		principal, err := store.Lookup(ctx, key)
+		if err != nil {
+			log.Ctx(ctx).Error().Stack().Err(err).Msg("API key lookup failed")
+			abortWithAPIKeyError(c, http.StatusServiceUnavailable, challenge, "api_keys_unavailable", "API keys cannot be verified at the moment", errors.Chain(err, "failed looking up API key"))
+			return
+		} else if principal == nil {
+			abortWithAPIKeyError(c, http.StatusUnauthorized, challenge, "invalid_api_key", "The API key is invalid", errors.New("API key is unknown"))
+			return
+		}
+
+		claims := &validator.ValidatedClaims{
+			RegisteredClaims: validator.RegisteredClaims{Subject: principal.Subject},
+			CustomClaims:     &OIDCClaims{Scope: strings.Join(principal.Scopes, " ")},
+		}
+		origReq := c.Request
+		c.Request = c.Request.WithContext(context.WithValue(ctx, jwtmiddleware.ContextKey{}, claims))
+		EnrichAccessLogPrincipal(c)
+		c.Next()
+		c.Request = origReq
+	}
+}
+
+// abortWithAPIKeyError aborts the request with the given error response, and records the failure reason in the access
+// log. Unauthorized responses carry the given authentication challenge, as required by RFC 7235.
+func abortWithAPIKeyError(c *gin.Context, status int, challenge, reason, description string, err error) {
+	_ = c.Error(err)
+	SetAccessLogField(c, "auth:error", reason)
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", challenge)
+	}
+	AbortWithErrorResponse(c, status, strings.ToUpper(reason), description)
+}
@@ -0,0 +1,215 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/secureworks/errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type failingKeyStore struct{}
+
+func (failingKeyStore) Lookup(context.Context, string) (*APIKeyPrincipal, error) {
+	return nil, errors.New("store is down")
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestAPIKeyGinMiddleware(t *testing.T) {
+	store := NewMemoryKeyStore(map[string]APIKeyPrincipal{
+		"reader-key": {Subject: "reader", Scopes: []string{"read"}},
+		"writer-key": {Subject: "writer", Scopes: []string{"write"}},
+	})
+	newEngine := func(store KeyStore, options ...APIKeyOption) *gin.Engine {
+		engine := gin.New()
+		engine.Use(CreateAPIKeyGinMiddleware(store, options...))
+		engine.GET("/", func(c *gin.Context) {
+			if !IsAuthenticated(c.Request.Context()) {
+				c.String(http.StatusOK, "anonymous")
+			} else if !HasClaimsScope(c.Request.Context(), "read") {
+				c.String(http.StatusForbidden, "forbidden")
+			} else {
+				c.String(http.StatusOK, GetClaims(c.Request.Context()).RegisteredClaims.Subject)
+			}
+		})
+		return engine
+	}
+
+	testCases := map[string]struct {
+		engine         *gin.Engine
+		target         string
+		header         string
+		expectedStatus int
+		expectedBody   string
+		expectedCode   string
+
+		// Defaults to the challenge of the default header for 401 responses
+		expectedAuthenticate string
+	}{
+		"header key":             {engine: newEngine(store), header: "reader-key", expectedStatus: http.StatusOK, expectedBody: "reader"},
+		"missing scope":          {engine: newEngine(store), header: "writer-key", expectedStatus: http.StatusForbidden},
+		"unknown key":            {engine: newEngine(store), header: "reader-key2", expectedStatus: http.StatusUnauthorized, expectedCode: "INVALID_API_KEY"},
+		"missing key":            {engine: newEngine(store), expectedStatus: http.StatusUnauthorized, expectedCode: "MISSING_API_KEY"},
+		"optional missing key":   {engine: newEngine(store, WithOptionalAPIKeyAuthentication()), expectedStatus: http.StatusOK, expectedBody: "anonymous"},
+		"optional unknown key":   {engine: newEngine(store, WithOptionalAPIKeyAuthentication()), header: "unknown", expectedStatus: http.StatusUnauthorized, expectedCode: "INVALID_API_KEY"},
+		"query key":              {engine: newEngine(store, WithAPIKeyQueryParameter("api_key")), target: "/?api_key=reader-key", expectedStatus: http.StatusOK, expectedBody: "reader"},
+		"query key not enabled":  {engine: newEngine(store), target: "/?api_key=reader-key", expectedStatus: http.StatusUnauthorized, expectedCode: "MISSING_API_KEY"},
+		"custom header":          {engine: newEngine(store, WithAPIKeyHeader("X-Other")), header: "reader-key", expectedStatus: http.StatusUnauthorized, expectedCode: "MISSING_API_KEY", expectedAuthenticate: `APIKey header="X-Other"`},
+		"unknown query key":      {engine: newEngine(store, WithAPIKeyQueryParameter("api_key")), target: "/?api_key=unknown", expectedStatus: http.StatusUnauthorized, expectedCode: "INVALID_API_KEY", expectedAuthenticate: `APIKey header="X-API-Key", query="api_key"`},
+		"store unavailable":      {engine: newEngine(failingKeyStore{}), header: "reader-key", expectedStatus: http.StatusServiceUnavailable, expectedCode: "API_KEYS_UNAVAILABLE"},
+		"header precedes query":  {engine: newEngine(store, WithAPIKeyQueryParameter("api_key")), target: "/?api_key=unknown", header: "reader-key", expectedStatus: http.StatusOK, expectedBody: "reader"},
+		"empty key is not a key": {engine: newEngine(NewMemoryKeyStore(map[string]APIKeyPrincipal{"": {Subject: "nobody"}})), expectedStatus: http.StatusUnauthorized, expectedCode: "MISSING_API_KEY"},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			target := tc.target
+			if target == "" {
+				target = "/"
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if tc.header != "" {
+				req.Header.Set("X-API-Key", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			tc.engine.ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			} else if tc.expectedBody != "" && rec.Body.String() != tc.expectedBody {
+				t.Errorf("Expected body '%s', got '%s'", tc.expectedBody, rec.Body.String())
+			} else if tc.expectedCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+tc.expectedCode+`"`) {
+				t.Errorf("Expected error code '%s', got: %s", tc.expectedCode, rec.Body.String())
+			}
+
+			expectedAuthenticate := tc.expectedAuthenticate
+			if expectedAuthenticate == "" && tc.expectedStatus == http.StatusUnauthorized {
+				expectedAuthenticate = `APIKey header="X-API-Key"`
+			}
+			if authenticate := rec.Header().Get("WWW-Authenticate"); authenticate != expectedAuthenticate {
+				t.Errorf("Expected WWW-Authenticate '%s', got '%s'", expectedAuthenticate, authenticate)
+			}
+		})
+	}
+}
+
+func TestAPIKeyGinMiddlewareCustomClaims(t *testing.T) {
+	engine := gin.New()
+	engine.Use(CreateAPIKeyGinMiddleware(NewMemoryKeyStore(map[string]APIKeyPrincipal{"key": {Subject: "integration", Scopes: []string{"read", "write"}}})))
+	engine.GET("/", func(c *gin.Context) {
+		claims, ok := GetCustomClaims[*OIDCClaims](c.Request.Context())
+		if !ok {
+			c.String(http.StatusInternalServerError, "no claims")
+		} else {
+			c.String(http.StatusOK, claims.Scope)
+		}
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "key")
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "read write" {
+		t.Errorf("Expected OIDC claims with scopes, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIKeyGinMiddlewareAccessLogRedaction(t *testing.T) {
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(GinAccessLogMiddleware)
+	engine.Use(CreateAPIKeyGinMiddleware(
+		NewMemoryKeyStore(map[string]APIKeyPrincipal{"s3cr3t-header": {Subject: "a"}, "s3cr3t-query": {Subject: "b"}}),
+		WithAPIKeyHeader("X-Integration-Key"),
+		WithAPIKeyQueryParameter("api_key"),
+	))
+	engine.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	headerReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	headerReq.Header.Set("X-Integration-Key", "s3cr3t-header")
+	queryReq := httptest.NewRequest(http.MethodGet, "/?page=2&api_key=s3cr3t-query", nil)
+	for _, req := range []*http.Request{headerReq, queryReq} {
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+		}
+	}
+
+	accessLog := accessLogBuffer.String()
+	if strings.Contains(accessLog, "s3cr3t") {
+		t.Errorf("Access log contains an API key: %s", accessLog)
+	} else if !strings.Contains(accessLog, `"http:req:header:x-integration-key":["********"]`) {
+		t.Errorf("Access log does not contain the redacted header: %s", accessLog)
+	} else if !strings.Contains(accessLog, "page=2&api_key=********") {
+		t.Errorf("Access log does not contain the redacted query: %s", accessLog)
+	}
+}
+
+func TestHashedFileKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed writing keys file: %+v", err)
+		}
+	}
+	lookup := func(store *HashedFileKeyStore, key string) *APIKeyPrincipal {
+		principal, err := store.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Failed looking up key: %+v", err)
+		}
+		return principal
+	}
+
+	write("# Integration keys\n\n" + hashAPIKey("key1") + " partner read write\n" + strings.ToUpper(hashAPIKey("key2")) + "  other\n")
+	store, err := NewHashedFileKeyStore(path)
+	if err != nil {
+		t.Fatalf("Failed loading keys: %+v", err)
+	}
+	if principal := lookup(store, "key1"); principal == nil || principal.Subject != "partner" || strings.Join(principal.Scopes, " ") != "read write" {
+		t.Errorf("Expected principal with scopes, got: %+v", principal)
+	} else if principal := lookup(store, "key2"); principal == nil || principal.Subject != "other" || len(principal.Scopes) != 0 {
+		t.Errorf("Expected principal without scopes, got: %+v", principal)
+	} else if principal := lookup(store, hashAPIKey("key1")); principal != nil {
+		t.Errorf("Expected hash to not be accepted as a key, got: %+v", principal)
+	}
+
+	write(hashAPIKey("key3") + " newcomer\n")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Failed reloading keys: %+v", err)
+	} else if lookup(store, "key1") != nil || lookup(store, "key3") == nil {
+		t.Errorf("Expected reloaded keys to replace previous keys")
+	}
+
+	for name, content := range map[string]string{
+		"missing subject": hashAPIKey("key4") + "\n",
+		"not a hash":      "key4 subject\n",
+		"truncated hash":  hashAPIKey("key4")[:32] + " subject\n",
+	} {
+		write(content)
+		if err := store.Reload(); err == nil {
+			t.Errorf("Expected reload of file with %s to fail", name)
+		} else if lookup(store, "key3") == nil {
+			t.Errorf("Expected previous keys to remain in effect after failed reload of file with %s", name)
+		}
+	}
+
+	if _, err := NewHashedFileKeyStore(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Expected missing keys file to fail loading")
+	}
+}
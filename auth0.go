@@ -3,10 +3,10 @@ package webutil
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/auth0/go-jwt-middleware/v2"
-	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
 	"github.com/gin-gonic/gin"
 	"github.com/secureworks/errors"
@@ -30,18 +30,32 @@ func HasScope(scopes, expectedScope string) bool {
 	return false
 }
 
+// ScopedClaims is implemented by custom claims types that carry OAuth scopes.
+type ScopedClaims interface {
+	HasScope(expectedScope string) bool
+}
+
+// HasClaimsScope checks whether the validated claims in the given context carry the given scope. This requires the
+// custom claims type of the JWT middleware to implement ScopedClaims.
+func HasClaimsScope(ctx context.Context, expectedScope string) bool {
+	claims, ok := GetCustomClaims[ScopedClaims](ctx)
+	return ok && claims.HasScope(expectedScope)
+}
+
+// GetClaims returns the validated claims in the given context, or nil if the request was not authenticated (or the
+// context holds a value of an unexpected type under the claims key).
 func GetClaims(ctx context.Context) *validator.ValidatedClaims {
-	v := ctx.Value(jwtmiddleware.ContextKey{})
-	if v == nil {
-		return nil
-	} else if claims, ok := v.(*validator.ValidatedClaims); ok {
-		return claims
-	} else {
-		panic(fmt.Sprintf("unexpected claims type '%T' encountered: %+v", v, v))
-	}
+	claims, _ := ctx.Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	return claims
 }
 
 func GetAccessToken(auth0Domain, m2mClientID, m2mClientSecret, apiAudience string) (string, error) {
+	return GetAccessTokenWithContext(context.Background(), auth0Domain, m2mClientID, m2mClientSecret, apiAudience)
+}
+
+// GetAccessTokenWithContext is like GetAccessToken, but makes the token request with the given context, so that it
+// can be cancelled and carries the ID of the request being handled (see NewRequestIDTransport).
+func GetAccessTokenWithContext(ctx context.Context, auth0Domain, m2mClientID, m2mClientSecret, apiAudience string) (string, error) {
 	accessTokenPayload := map[string]interface{}{
 		"client_id":     m2mClientID,
 		"client_secret": m2mClientSecret,
@@ -54,13 +68,13 @@ func GetAccessToken(auth0Domain, m2mClientID, m2mClientSecret, apiAudience strin
 	}
 
 	auth0ManagementURL := "https://" + auth0Domain + "/oauth/token"
-	req, err := http.NewRequest("POST", auth0ManagementURL, bytes.NewReader(payload))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth0ManagementURL, bytes.NewReader(payload))
 	if err != nil {
 		return "", errors.Chain(err, "failed creating access token request")
 	}
 	req.Header.Add("content-type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := HTTPClient.Do(req)
 	if err != nil {
 		return "", errors.Chain(err, "failed executing access token request")
 	}
@@ -85,49 +99,196 @@ func GetAccessToken(auth0Domain, m2mClientID, m2mClientSecret, apiAudience strin
 	}
 }
 
+type jwtSettings struct {
+	tokenExtractors     []jwtmiddleware.TokenExtractor
+	optional            bool
+	clockSkew           time.Duration
+	jwksCacheTTL        time.Duration
+	jwksMaxStaleness    time.Duration
+	jwksRefetchInterval time.Duration
+	jwksRefreshContext  context.Context
+	jwksRefreshInterval time.Duration
+	jwksHTTPClient      *http.Client
+
+	introspectionCacheTTL         time.Duration
+	introspectionNegativeCacheTTL time.Duration
+	introspectionHTTPClient       *http.Client
+	introspectionIssuer           string
+}
+
+type JWTOption func(*jwtSettings)
+
+func newJWTSettings(options ...JWTOption) *jwtSettings {
+	settings := &jwtSettings{
+		clockSkew:           time.Minute,
+		jwksCacheTTL:        5 * time.Minute,
+		jwksMaxStaleness:    time.Hour,
+		jwksRefetchInterval: 30 * time.Second,
+		jwksHTTPClient:      HTTPClient,
+
+		introspectionCacheTTL:         5 * time.Minute,
+		introspectionNegativeCacheTTL: 10 * time.Second,
+		introspectionHTTPClient:       HTTPClient,
+	}
+	for _, option := range options {
+		option(settings)
+	}
+	if len(settings.tokenExtractors) == 0 {
+		settings.tokenExtractors = []jwtmiddleware.TokenExtractor{AuthorizationHeaderTokenExtractor()}
+	}
+	return settings
+}
+
+// WithJWTTokenExtractors makes the JWT middleware extract tokens using the given extractors, in order, instead of the
+// default AuthorizationHeaderTokenExtractor.
+func WithJWTTokenExtractors(tokenExtractors ...jwtmiddleware.TokenExtractor) JWTOption {
+	return func(s *jwtSettings) { s.tokenExtractors = append(s.tokenExtractors, tokenExtractors...) }
+}
+
+// WithOptionalJWTAuthentication makes the JWT middleware let requests without a token through anonymously (see
+// IsAuthenticated). Requests with invalid tokens are still rejected.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithOptionalJWTAuthentication() JWTOption {
+	return func(s *jwtSettings) { s.optional = true }
+}
+
+// WithJWTClockSkew sets the clock skew tolerated when validating token timestamps (1 minute by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJWTClockSkew(skew time.Duration) JWTOption {
+	return func(s *jwtSettings) { s.clockSkew = skew }
+}
+
+// IsAuthenticated checks whether the given context carries validated claims, i.e. whether the request was
+// authenticated rather than let through anonymously.
+func IsAuthenticated(ctx context.Context) bool {
+	claims, ok := ctx.Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	return ok && claims != nil
+}
+
 func CreateAuth0JWTValidationGinMiddleware(
 	auth0Domain string,
 	audiences []string,
 	algorithm validator.SignatureAlgorithm,
 	customClaimsFunc func() validator.CustomClaims,
 	tokenExtractors ...jwtmiddleware.TokenExtractor) func(c *gin.Context) {
+	return CreateAuth0JWTValidationGinMiddlewareWithOptions(
+		auth0Domain,
+		audiences,
+		algorithm,
+		customClaimsFunc,
+		WithJWTTokenExtractors(tokenExtractors...),
+	)
+}
+
+func CreateAuth0JWTValidationGinMiddlewareWithOptions(
+	auth0Domain string,
+	audiences []string,
+	algorithm validator.SignatureAlgorithm,
+	customClaimsFunc func() validator.CustomClaims,
+	options ...JWTOption) func(c *gin.Context) {
+	settings := newJWTSettings(options...)
+
 	issuerURL, err := url.Parse("https://" + auth0Domain + "/")
 	if err != nil {
 		panic(fmt.Errorf("failed to parse issuer URL: %w", err))
 	}
 
-	provider := jwks.NewCachingProvider(issuerURL, 5*time.Minute)
+	provider := newJWKSProvider(issuerURL, settings)
+	validateToken, err := newJWTTokenValidator(provider.KeyFunc, algorithm, issuerURL.String(), audiences, customClaimsFunc, settings.clockSkew)
+	if err != nil {
+		panic(fmt.Errorf("failed to set up a JWT validator: %w", err))
+	}
+	return newBearerTokenGinMiddleware(settings, validateToken)
+}
+
+// newJWTTokenValidator creates a function validating JWTs & returning their validated claims. Failures of the key func
+// and of custom claims validation are reported as JWTErrors, so they can be told apart from other validation errors
+// without relying on the error messages of the validator.
+func newJWTTokenValidator(
+	keyFunc func(ctx context.Context) (interface{}, error),
+	algorithm validator.SignatureAlgorithm,
+	issuer string,
+	audiences []string,
+	customClaimsFunc func() validator.CustomClaims,
+	clockSkew time.Duration) (func(ctx context.Context, token string) (interface{}, error), error) {
 	jwtValidator, err := validator.New(
-		provider.KeyFunc,
+		func(ctx context.Context) (interface{}, error) {
+			keys, err := keyFunc(ctx)
+			if err != nil {
+				return nil, &JWTError{Reason: JWTKeysUnavailable, Err: err}
+			}
+			return keys, nil
+		},
 		algorithm,
-		issuerURL.String(),
+		issuer,
 		audiences,
-		validator.WithCustomClaims(customClaimsFunc),
-		validator.WithAllowedClockSkew(time.Minute),
+		validator.WithAllowedClockSkew(clockSkew),
 	)
 	if err != nil {
-		panic(fmt.Errorf("failed to set up a JWT validator: %w", err))
+		return nil, err
 	}
 
+	return func(ctx context.Context, token string) (interface{}, error) {
+		v, err := jwtValidator.ValidateToken(withTokenKeyID(ctx, token), token)
+		if err != nil {
+			return nil, err
+		}
+		claims := v.(*validator.ValidatedClaims)
+		if customClaimsFunc == nil {
+			return claims, nil
+		} else if customClaims := customClaimsFunc(); customClaims != nil {
+			// The signature was verified above, so the payload can be decoded directly
+			_, encodedPayload, _ := strings.Cut(token, ".")
+			encodedPayload, _, _ = strings.Cut(encodedPayload, ".")
+			if payload, err := base64.RawURLEncoding.DecodeString(encodedPayload); err != nil {
+				return nil, &JWTError{Reason: JWTMalformed, Err: errors.Chain(err, "failed decoding token payload")}
+			} else if err := json.Unmarshal(payload, customClaims); err != nil {
+				return nil, &JWTError{Reason: JWTInvalidClaims, Err: errors.Chain(err, "failed decoding custom claims")}
+			} else if err := customClaims.Validate(ctx); err != nil {
+				return nil, customClaimsError(err)
+			}
+			claims.CustomClaims = customClaims
+		}
+		return claims, nil
+	}, nil
+}
+
+// newBearerTokenGinMiddleware creates a middleware validating bearer tokens using the given function, which returns
+// the validated claims.
+//
+// Mirrors jwtmiddleware.JWTMiddleware.CheckJWT, but runs directly against the gin context instead of constructing a
+// middleware & handler chain for every request.
+func newBearerTokenGinMiddleware(settings *jwtSettings, validateToken func(ctx context.Context, token string) (interface{}, error)) func(c *gin.Context) {
+	tokenExtractor := jwtmiddleware.MultiTokenExtractor(settings.tokenExtractors...)
 	return func(c *gin.Context) {
-		middleware := jwtmiddleware.New(
-			jwtValidator.ValidateToken,
-			jwtmiddleware.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
-				_ = c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("failed to validate JWT: %w", err))
-			}),
-			jwtmiddleware.WithTokenExtractor(jwtmiddleware.MultiTokenExtractor(tokenExtractors...)),
-		)
-
-		next := func(w http.ResponseWriter, r *http.Request) {
-			// The JWT middleware "CheckJWT" method will set the validated claims in the provided request context
-			// Therefore, we need to make sure that our Gin context has the same request context so the claims are
-			// available to the rest of the request handling code.
-			origReq := c.Request
-			c.Request = r
-			c.Next()
-			c.Request = origReq
+		token, err := tokenExtractor(c.Request)
+		if err != nil {
+			abortWithJWTError(c, errors.Chain(err, "error extracting token"))
+			return
+		} else if token == "" {
+			if settings.optional {
+				c.Next()
+			} else {
+				abortWithJWTError(c, jwtmiddleware.ErrJWTMissing)
+			}
+			return
 		}
-		handler := middleware.CheckJWT(http.HandlerFunc(next))
-		handler.ServeHTTP(c.Writer, c.Request)
+
+		ctx := c.Request.Context()
+		claims, err := validateToken(ctx, token)
+		if err != nil {
+			abortWithJWTError(c, err)
+			return
+		}
+
+		// Expose the validated claims to the rest of the request handling code via the request context, the same way
+		// the JWT middleware does
+		origReq := c.Request
+		c.Request = c.Request.WithContext(context.WithValue(ctx, jwtmiddleware.ContextKey{}, claims))
+		EnrichAccessLogPrincipal(c)
+		c.Next()
+		c.Request = origReq
 	}
 }
@@ -0,0 +1,91 @@
+package webutil
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"strings"
+	"testing"
+)
+
+func TestGetCustomClaims(t *testing.T) {
+	oidcClaims := &OIDCClaims{Scope: "read write"}
+	ctx := context.WithValue(context.Background(), jwtmiddleware.ContextKey{}, &validator.ValidatedClaims{CustomClaims: oidcClaims})
+
+	if claims, ok := GetCustomClaims[*OIDCClaims](ctx); !ok || claims != oidcClaims {
+		t.Errorf("Expected OIDC claims, got %+v (%v)", claims, ok)
+	}
+	if claims, ok := GetCustomClaims[ScopedClaims](ctx); !ok || !claims.HasScope("write") {
+		t.Errorf("Expected scoped claims, got %+v (%v)", claims, ok)
+	}
+	if claims, ok := GetCustomClaims[*testScopedClaims](ctx); ok || claims != nil {
+		t.Errorf("Expected claims of another type to be absent, got %+v", claims)
+	}
+	if _, ok := GetCustomClaims[*OIDCClaims](context.Background()); ok {
+		t.Errorf("Expected claims to be absent from empty context")
+	}
+	badCtx := context.WithValue(context.Background(), jwtmiddleware.ContextKey{}, "not claims")
+	if _, ok := GetCustomClaims[*OIDCClaims](badCtx); ok {
+		t.Errorf("Expected unexpected claims type to be treated as absent")
+	}
+
+	if claims := MustGetCustomClaims[*OIDCClaims](ctx); claims != oidcClaims {
+		t.Errorf("Expected OIDC claims, got %+v", claims)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected MustGetCustomClaims to panic on missing claims")
+		}
+	}()
+	MustGetCustomClaims[*OIDCClaims](context.Background())
+}
+
+func TestOIDCClaims(t *testing.T) {
+	payload := `{
+		"scope": "read:items write:items",
+		"permissions": ["read:items"],
+		"email": "jack@example.com",
+		"org_id": "org_123",
+		"roles": ["admin"],
+		"azp": "m2m-client",
+		"gty": "client-credentials"
+	}`
+	claims := NewOIDCClaims("read:items")().(*OIDCClaims)
+	if err := json.Unmarshal([]byte(payload), claims); err != nil {
+		t.Fatalf("Failed unmarshalling claims: %+v", err)
+	}
+	if err := claims.Validate(context.Background()); err != nil {
+		t.Errorf("Expected claims to be valid: %+v", err)
+	}
+	if !claims.HasScope("write:items") || claims.HasScope("delete:items") {
+		t.Errorf("Unexpected scope checks for %+v", claims)
+	}
+	if !claims.HasPermission("read:items") || claims.HasPermission("write:items") {
+		t.Errorf("Unexpected permission checks for %+v", claims)
+	}
+	if !claims.HasRole("admin") || claims.HasRole("") {
+		t.Errorf("Unexpected role checks for %+v", claims)
+	}
+	if claims.OrgID != "org_123" || claims.Email != "jack@example.com" || !claims.IsMachineToMachine() {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	missing := NewOIDCClaims("admin:items")().(*OIDCClaims)
+	if err := json.Unmarshal([]byte(payload), missing); err != nil {
+		t.Fatalf("Failed unmarshalling claims: %+v", err)
+	} else if err := missing.Validate(context.Background()); err == nil {
+		t.Errorf("Expected claims without required scope to be invalid")
+	}
+}
+
+func TestMustGetCustomClaimsPanicMessage(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Expected MustGetCustomClaims to panic on missing claims")
+		} else if msg, _ := r.(string); !strings.Contains(msg, "webutil.ScopedClaims") {
+			t.Errorf("Expected panic message to name the interface type, got: %v", r)
+		}
+	}()
+	MustGetCustomClaims[ScopedClaims](context.Background())
+}
@@ -1,14 +1,27 @@
 package webutil
 
 import (
+	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type HTTPConfig struct {
-	Port int        `env:"PORT" value-name:"PORT" long:"port" description:"Port to listen on" default:"8000"`
-	CORS CORSConfig `group:"cors" namespace:"cors" env-namespace:"CORS"`
+	Port               int               `env:"PORT" value-name:"PORT" long:"port" description:"Port to listen on" default:"8000"`
+	MaxRequestBodySize int64             `env:"MAX_REQUEST_BODY_SIZE" value-name:"BYTES" long:"max-request-body-size" description:"Maximum size of request bodies, enforced by HTTPConfig.Configure (zero for no limit)" default:"10485760"`
+	ShutdownTimeout    time.Duration     `env:"SHUTDOWN_TIMEOUT" value-name:"DURATION" long:"shutdown-timeout" description:"How long to wait for in-flight requests when shutting down" default:"30s"`
+	UnixSocket         string            `env:"UNIX_SOCKET" value-name:"PATH" long:"unix-socket" description:"Listen on this unix socket instead of the TCP port"`
+	ListenFD           int               `env:"LISTEN_FD" value-name:"FD" long:"listen-fd" description:"Serve on this inherited listener file descriptor (e.g. 3 for systemd socket activation) instead of the TCP port"`
+	TLS                TLSConfig         `group:"tls" namespace:"tls" env-namespace:"TLS"`
+	HTTP2              HTTP2Config       `group:"http2" namespace:"http2" env-namespace:"HTTP2"`
+	CORS               CORSConfig        `group:"cors" namespace:"cors" env-namespace:"CORS"`
+	Compression        CompressionConfig `group:"compression" namespace:"compression" env-namespace:"COMPRESSION"`
+	AccessLog          AccessLogConfig   `group:"access-log" namespace:"access-log" env-namespace:"ACCESS_LOG"`
 }
 
 type CORSConfig struct {
@@ -20,7 +33,47 @@ type CORSConfig struct {
 	MaxAge             time.Duration `env:"MAX_AGE" value-name:"DURATION" long:"max-age" description:"How long results of preflights response can be cached (https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Max-Age)" default:"60s"`
 }
 
-func (c *CORSConfig) Configure(router *gin.Engine) {
+func (c *HTTPConfig) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid port %d", c.Port))
+	} else if c.MaxRequestBodySize < 0 {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid max request body size %d", c.MaxRequestBodySize))
+	} else if c.ListenFD < 0 || (c.ListenFD > 0 && c.ListenFD < 3) {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid listener file descriptor %d", c.ListenFD))
+	} else if c.ListenFD > 0 && c.UnixSocket != "" {
+		return errors.New("unix socket and listener file descriptor are mutually exclusive")
+	}
+	return nil
+}
+
+// Configure installs the middlewares enforcing this configuration's request limits on the given router. Nested
+// configurations (e.g. CORS & compression) are configured separately.
+func (c *HTTPConfig) Configure(router *gin.Engine) {
+	if c.MaxRequestBodySize > 0 {
+		router.Use(CreateGinMaxBodySizeMiddleware(c.MaxRequestBodySize))
+	}
+}
+
+func (c *CORSConfig) Validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return errors.New("at least one allowed origin is required")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		} else if u, err := url.Parse(strings.ReplaceAll(origin, "*", "wildcard")); err != nil {
+			return errors.Chain(err, "invalid allowed origin '%s'", origin)
+		} else if u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return errors.NewWithStackTrace(fmt.Sprintf("invalid allowed origin '%s': must be in the form 'scheme://host[:port]'", origin))
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid max age %s", c.MaxAge))
+	}
+	return nil
+}
+
+func (c *CORSConfig) newMiddleware() gin.HandlerFunc {
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowOrigins = c.AllowedOrigins
 	corsConfig.AddAllowMethods(c.AllowMethods...)
@@ -33,7 +86,35 @@ func (c *CORSConfig) Configure(router *gin.Engine) {
 	corsConfig.AllowWebSockets = true
 	corsConfig.AllowWildcard = true
 	corsConfig.MaxAge = c.MaxAge
-	corsMiddleware := cors.New(corsConfig)
+	return cors.New(corsConfig)
+}
+
+func (c *CORSConfig) Configure(router *gin.Engine) {
+	corsMiddleware := c.newMiddleware()
+	router.OPTIONS("/*path", corsMiddleware)
+	router.Use(corsMiddleware)
+}
+
+type corsMiddlewareCache struct {
+	config     *CORSConfig
+	middleware gin.HandlerFunc
+}
+
+// ConfigureReloadableGinCORS installs a CORS middleware that reads its settings through the given function on every
+// request (e.g. from a ReloadableConfig), rebuilding itself whenever a different configuration is returned.
+//
+//goland:noinspection GoUnusedExportedFunction
+func ConfigureReloadableGinCORS(router *gin.Engine, config func() *CORSConfig) {
+	var cache atomic.Pointer[corsMiddlewareCache]
+	corsMiddleware := func(c *gin.Context) {
+		cfg := config()
+		cached := cache.Load()
+		if cached == nil || cached.config != cfg {
+			cached = &corsMiddlewareCache{config: cfg, middleware: cfg.newMiddleware()}
+			cache.Store(cached)
+		}
+		cached.middleware(c)
+	}
 	router.OPTIONS("/*path", corsMiddleware)
 	router.Use(corsMiddleware)
 }
@@ -0,0 +1,291 @@
+package webutil
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const redactedValue = "********"
+
+var sensitiveConfigNamePattern = regexp.MustCompile(`(?i)(secret|password|passwd|token|private|credential|api-?key)`)
+
+type Validator interface {
+	Validate() error
+}
+
+type configLoader struct {
+	args         []string
+	configFile   string
+	dumpDisabled bool
+}
+
+type ConfigOption func(*configLoader)
+
+// WithConfigFile loads configuration values from the given YAML or TOML file (chosen by its extension). File values
+// take precedence over defaults, but are overridden by environment variables and command-line flags.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithConfigFile(path string) ConfigOption {
+	return func(l *configLoader) { l.configFile = path }
+}
+
+// WithArgs parses the given command-line arguments instead of os.Args.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithArgs(args []string) ConfigOption {
+	return func(l *configLoader) { l.args = args }
+}
+
+// WithoutConfigDump disables logging the effective configuration after it is loaded.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithoutConfigDump() ConfigOption {
+	return func(l *configLoader) { l.dumpDisabled = true }
+}
+
+// LoadConfig populates the given configuration struct from (in increasing order of precedence) its "default" tags, a
+// configuration file, environment variables and command-line flags, as described by its go-flags struct tags. The
+// resulting configuration is then validated, and logged with sensitive values redacted.
+//
+//goland:noinspection GoUnusedExportedFunction
+func LoadConfig(cfg interface{}, options ...ConfigOption) error {
+	loader := &configLoader{args: os.Args[1:]}
+	for _, option := range options {
+		option(loader)
+	}
+
+	parser := flags.NewParser(cfg, flags.HelpFlag|flags.PassDoubleDash)
+	if loader.configFile != "" {
+		values, err := readConfigFile(loader.configFile)
+		if err != nil {
+			return err
+		}
+		if err := applyConfigFileValues(parser, values); err != nil {
+			return errors.Chain(err, "failed applying configuration file '%s'", loader.configFile)
+		}
+	}
+
+	if args, err := parser.ParseArgs(loader.args); err != nil {
+		if flags.WroteHelp(err) {
+			return err
+		}
+		return errors.Chain(err, "failed parsing configuration")
+	} else if len(args) > 0 {
+		return errors.NewWithStackTrace(fmt.Sprintf("unexpected command-line arguments: %v", args))
+	}
+
+	if err := ValidateConfig(cfg); err != nil {
+		return errors.Chain(err, "invalid configuration")
+	}
+
+	if !loader.dumpDisabled {
+		log.Info().Fields(redactedValues(parser)).Msg("Effective configuration")
+	}
+	return nil
+}
+
+// ValidateConfig invokes the Validate method of the given configuration and of all nested structs that implement it,
+// and checks that the admin server (see AdminConfig) does not listen on the port of any HTTP server in it.
+func ValidateConfig(cfg interface{}) error {
+	if err := validateConfigValue(reflect.ValueOf(cfg), ""); err != nil {
+		return err
+	}
+	return validateAdminPorts(reflect.ValueOf(cfg))
+}
+
+func validateAdminPorts(v reflect.Value) error {
+	var httpConfigs []*HTTPConfig
+	var adminConfigs []*AdminConfig
+	eachConfigStruct(v, func(cfg interface{}) {
+		switch c := cfg.(type) {
+		case *HTTPConfig:
+			httpConfigs = append(httpConfigs, c)
+		case *AdminConfig:
+			adminConfigs = append(adminConfigs, c)
+		}
+	})
+	for _, admin := range adminConfigs {
+		if admin.Disabled || admin.Port == 0 {
+			continue
+		}
+		for _, public := range httpConfigs {
+			if public.UnixSocket == "" && public.ListenFD == 0 && public.Port == admin.Port {
+				return errors.NewWithStackTrace(fmt.Sprintf("admin port %d must differ from the public port", admin.Port))
+			}
+		}
+	}
+	return nil
+}
+
+// eachConfigStruct invokes the given function with a pointer to the given configuration and to each of its nested
+// structs.
+func eachConfigStruct(v reflect.Value, f func(cfg interface{})) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return
+		}
+	} else if v.CanAddr() {
+		v = v.Addr()
+	} else {
+		return
+	}
+	elem := v.Elem()
+	if elem.Kind() != reflect.Struct {
+		return
+	}
+	f(v.Interface())
+	for i := 0; i < elem.NumField(); i++ {
+		if elem.Type().Field(i).IsExported() {
+			eachConfigStruct(elem.Field(i), f)
+		}
+	}
+}
+
+func validateConfigValue(v reflect.Value, path string) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+	} else if v.CanAddr() {
+		v = v.Addr()
+	}
+
+	if validator, ok := v.Interface().(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if path == "" {
+				return err
+			}
+			return errors.Chain(err, "invalid '%s'", path)
+		}
+	}
+
+	elem := v.Elem()
+	if elem.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < elem.NumField(); i++ {
+		field := elem.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		} else if kind := field.Type.Kind(); kind != reflect.Struct && !(kind == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct) {
+			continue
+		}
+		fieldPath := field.Name
+		if path != "" {
+			fieldPath = path + "." + field.Name
+		}
+		if err := validateConfigValue(elem.Field(i), fieldPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Chain(err, "failed reading configuration file '%s'", path)
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, errors.NewWithStackTrace(fmt.Sprintf("unsupported configuration file type '%s'", path))
+	}
+	if err != nil {
+		return nil, errors.Chain(err, "failed parsing configuration file '%s'", path)
+	}
+	return values, nil
+}
+
+// flattenConfigValues converts nested configuration maps into a flat map keyed by namespaced option names
+func flattenConfigValues(prefix string, values map[string]interface{}, target map[string][]string) {
+	for key, value := range values {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenConfigValues(name, v, target)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			target[name] = items
+		case nil:
+		default:
+			target[name] = []string{fmt.Sprint(v)}
+		}
+	}
+}
+
+func eachConfigOption(group *flags.Group, visit func(option *flags.Option)) {
+	for _, option := range group.Options() {
+		visit(option)
+	}
+	for _, child := range group.Groups() {
+		eachConfigOption(child, visit)
+	}
+}
+
+func applyConfigFileValues(parser *flags.Parser, values map[string]interface{}) error {
+	flat := make(map[string][]string)
+	flattenConfigValues("", values, flat)
+
+	// File values become the options' defaults, so that environment variables & flags still override them
+	eachConfigOption(parser.Group, func(option *flags.Option) {
+		if value, ok := flat[option.LongNameWithNamespace()]; ok {
+			option.Default = value
+			delete(flat, option.LongNameWithNamespace())
+		}
+	})
+
+	if len(flat) > 0 {
+		var unknown []string
+		for name := range flat {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return errors.NewWithStackTrace(fmt.Sprintf("unknown configuration keys: %s", strings.Join(unknown, ", ")))
+	}
+	return nil
+}
+
+func isSensitiveConfigOption(option *flags.Option) bool {
+	if secret := option.Field().Tag.Get("secret"); secret != "" {
+		return secret == "true" || secret == "yes"
+	}
+	return sensitiveConfigNamePattern.MatchString(option.LongName) || sensitiveConfigNamePattern.MatchString(option.Field().Name)
+}
+
+func redactedValues(parser *flags.Parser) map[string]interface{} {
+	values := make(map[string]interface{})
+	eachConfigOption(parser.Group, func(option *flags.Option) {
+		name := option.LongNameWithNamespace()
+		if name == "" {
+			name = option.Field().Name
+		}
+		if isSensitiveConfigOption(option) {
+			values[name] = redactedValue
+		} else {
+			values[name] = option.Value()
+		}
+	})
+	return values
+}
@@ -0,0 +1,151 @@
+package webutil
+
+import (
+	"github.com/jessevdk/go-flags"
+	"github.com/secureworks/errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServiceConfig struct {
+	HTTP     HTTPConfig `group:"http" namespace:"http" env-namespace:"HTTP"`
+	Name     string     `env:"NAME" long:"name" default:"service"`
+	APIToken string     `env:"API_TOKEN" long:"api-token"`
+}
+
+func writeTestConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed writing config file: %+v", err)
+	}
+	return path
+}
+
+func errorChainMessages(err error) string {
+	var messages []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, ": ")
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	yamlFile := writeTestConfigFile(t, "config.yaml", `
+name: from-file
+http:
+  port: 9000
+  max-request-body-size: 1024
+  cors:
+    allowed-origins: ["https://a.example.com", "https://b.example.com"]
+    max-age: 5m
+`)
+	t.Setenv("HTTP_PORT", "9001")
+
+	cfg := testServiceConfig{}
+	if err := LoadConfig(&cfg, WithConfigFile(yamlFile), WithArgs([]string{"--name=from-flag"}), WithoutConfigDump()); err != nil {
+		t.Fatalf("Failed loading config: %+v", err)
+	}
+
+	if cfg.Name != "from-flag" {
+		t.Errorf("Expected flag to override file, got name '%s'", cfg.Name)
+	}
+	if cfg.HTTP.Port != 9001 {
+		t.Errorf("Expected environment to override file, got port %d", cfg.HTTP.Port)
+	}
+	if cfg.HTTP.MaxRequestBodySize != 1024 {
+		t.Errorf("Expected file to override default, got max request body size %d", cfg.HTTP.MaxRequestBodySize)
+	}
+	if expected := []string{"https://a.example.com", "https://b.example.com"}; !reflect.DeepEqual(cfg.HTTP.CORS.AllowedOrigins, expected) {
+		t.Errorf("Expected allowed origins %v, got %v", expected, cfg.HTTP.CORS.AllowedOrigins)
+	}
+	if cfg.HTTP.CORS.MaxAge != 5*time.Minute {
+		t.Errorf("Expected CORS max age of 5m, got %s", cfg.HTTP.CORS.MaxAge)
+	}
+	if cfg.HTTP.Compression.MinSize != 1024 {
+		t.Errorf("Expected default compression min size of 1024, got %d", cfg.HTTP.Compression.MinSize)
+	}
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	tomlFile := writeTestConfigFile(t, "config.toml", `
+[http]
+port = 7000
+
+[http.cors]
+allowed-origins = ["https://*.example.com"]
+`)
+	cfg := testServiceConfig{}
+	if err := LoadConfig(&cfg, WithConfigFile(tomlFile), WithArgs(nil), WithoutConfigDump()); err != nil {
+		t.Fatalf("Failed loading config: %+v", err)
+	} else if cfg.HTTP.Port != 7000 {
+		t.Errorf("Expected port 7000, got %d", cfg.HTTP.Port)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	cases := map[string]struct {
+		args          []string
+		expectedError string
+	}{
+		"missing required":  {[]string{}, "http.cors.allowed-origins"},
+		"invalid origin":    {[]string{"--http.cors.allowed-origins=example.com"}, "invalid allowed origin"},
+		"invalid port":      {[]string{"--http.cors.allowed-origins=https://example.com", "--http.port=70000"}, "invalid port"},
+		"unexpected args":   {[]string{"--http.cors.allowed-origins=https://example.com", "extra"}, "unexpected command-line arguments"},
+		"invalid flag type": {[]string{"--http.port=abc"}, "invalid argument"},
+	}
+	for name, c := range cases {
+		cfg := testServiceConfig{}
+		if err := LoadConfig(&cfg, WithArgs(c.args), WithoutConfigDump()); err == nil {
+			t.Errorf("Expected '%s' to fail loading config", name)
+		} else if messages := errorChainMessages(err); !strings.Contains(messages, c.expectedError) {
+			t.Errorf("Expected '%s' error to contain '%s', got: %s", name, c.expectedError, messages)
+		}
+	}
+
+	unknownKeysFile := writeTestConfigFile(t, "config.yml", "http:\n  unknown: 1\n")
+	if err := LoadConfig(&testServiceConfig{}, WithConfigFile(unknownKeysFile), WithArgs(nil), WithoutConfigDump()); err == nil {
+		t.Errorf("Expected unknown configuration file keys to fail loading config")
+	}
+}
+
+func TestRedactedConfigValues(t *testing.T) {
+	cfg := testServiceConfig{}
+	parser := flags.NewParser(&cfg, flags.None)
+	if _, err := parser.ParseArgs([]string{"--api-token=s3cr3t", "--http.cors.allowed-origins=https://example.com"}); err != nil {
+		t.Fatalf("Failed parsing args: %+v", err)
+	}
+	values := redactedValues(parser)
+	if values["api-token"] != redactedValue {
+		t.Errorf("Expected API token to be redacted, got '%v'", values["api-token"])
+	} else if values["name"] != "service" {
+		t.Errorf("Expected name to be dumped as is, got '%v'", values["name"])
+	}
+}
+
+func TestValidateConfigAdminPort(t *testing.T) {
+	type serviceConfig struct {
+		HTTP  HTTPConfig
+		Admin AdminConfig
+	}
+	cases := map[string]struct {
+		cfg         serviceConfig
+		expectValid bool
+	}{
+		"distinct ports":     {serviceConfig{HTTP: HTTPConfig{Port: 8000}, Admin: AdminConfig{Port: 8001}}, true},
+		"same port":          {serviceConfig{HTTP: HTTPConfig{Port: 8000}, Admin: AdminConfig{Port: 8000}}, false},
+		"admin disabled":     {serviceConfig{HTTP: HTTPConfig{Port: 8000}, Admin: AdminConfig{Port: 8000, Disabled: true}}, true},
+		"public unix socket": {serviceConfig{HTTP: HTTPConfig{Port: 8000, UnixSocket: "/tmp/app.sock"}, Admin: AdminConfig{Port: 8000}}, true},
+	}
+	for name, c := range cases {
+		c.cfg.HTTP.CORS.AllowedOrigins = []string{"https://example.com"}
+		if err := ValidateConfig(&c.cfg); c.expectValid && err != nil {
+			t.Errorf("Expected '%s' to be valid, got: %+v", name, err)
+		} else if !c.expectValid && (err == nil || !strings.Contains(err.Error(), "must differ from the public port")) {
+			t.Errorf("Expected '%s' to be rejected for sharing the public port, got: %v", name, err)
+		}
+	}
+}
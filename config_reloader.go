@@ -0,0 +1,98 @@
+package webutil
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// ReloadableConfig holds a configuration that can be reloaded at runtime. Readers always observe a complete, validated
+// configuration: reloads populate a fresh value and swap it in atomically only if it loaded and validated successfully.
+type ReloadableConfig[T any] struct {
+	current   atomic.Pointer[T]
+	load      func(cfg *T) error
+	mutex     sync.Mutex
+	listeners []func(cfg *T)
+}
+
+// NewReloadableConfig creates a reloadable configuration, performing the initial load with the given function (e.g.
+// one that invokes LoadConfig) which is also used for subsequent reloads.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewReloadableConfig[T any](load func(cfg *T) error) (*ReloadableConfig[T], error) {
+	r := &ReloadableConfig[T]{load: load}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get returns the current configuration, which must be treated as read-only.
+func (r *ReloadableConfig[T]) Get() *T {
+	return r.current.Load()
+}
+
+// OnReload registers a function to be invoked with every newly loaded configuration.
+func (r *ReloadableConfig[T]) OnReload(listener func(cfg *T)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+// Reload loads & validates a new configuration, and swaps it in if successful. Invalid configurations are rejected
+// and logged, and the current configuration remains in effect.
+func (r *ReloadableConfig[T]) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cfg := new(T)
+	if err := r.load(cfg); err != nil {
+		err = errors.Chain(err, "failed loading configuration")
+		log.Error().Stack().Err(err).Msg("Configuration reload rejected")
+		return err
+	} else if err := ValidateConfig(cfg); err != nil {
+		err = errors.Chain(err, "invalid configuration")
+		log.Error().Stack().Err(err).Msg("Configuration reload rejected")
+		return err
+	}
+
+	initial := r.current.Swap(cfg) == nil
+	for _, listener := range r.listeners {
+		listener(cfg)
+	}
+	if !initial {
+		log.Info().Msg("Configuration reloaded")
+	}
+	return nil
+}
+
+// WatchFiles reloads the configuration whenever any of the given files change, until the given context is done.
+func (r *ReloadableConfig[T]) WatchFiles(ctx context.Context, paths ...string) error {
+	return watchFiles(ctx, func() { _ = r.Reload() }, paths...)
+}
+
+// WatchSignals reloads the configuration whenever one of the given signals (SIGHUP if none given) is received, until
+// the given context is done.
+func (r *ReloadableConfig[T]) WatchSignals(ctx context.Context, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				_ = r.Reload()
+			}
+		}
+	}()
+}
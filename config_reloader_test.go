@@ -0,0 +1,105 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadableConfig(t *testing.T) {
+	path := writeTestConfigFile(t, "config.yaml", `
+http:
+  cors:
+    allowed-origins: ["https://a.example.com"]
+`)
+	reloadable, err := NewReloadableConfig(func(cfg *testServiceConfig) error {
+		return LoadConfig(cfg, WithConfigFile(path), WithArgs(nil), WithoutConfigDump())
+	})
+	if err != nil {
+		t.Fatalf("Failed creating reloadable config: %+v", err)
+	}
+
+	engine := gin.New()
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(CreateGinAccessLogMiddleware(WithAccessLogConfig(func() *AccessLogConfig { return &reloadable.Get().HTTP.AccessLog })))
+	ConfigureReloadableGinCORS(engine, func() *CORSConfig { return &reloadable.Get().HTTP.CORS })
+	engine.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	assertAllowedOrigin := func(origin string, expectedAllowed bool) {
+		t.Helper()
+		accessLogBuffer.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if allowed := rec.Header().Get("Access-Control-Allow-Origin") == origin; allowed != expectedAllowed {
+			t.Errorf("Expected origin '%s' allowed=%v, got %d with allowed origin '%s'", origin, expectedAllowed, rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+	accessLogAuthorization := func() interface{} {
+		accessLog := make(map[string]interface{})
+		if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+			t.Fatalf("Failed unmarshalling access log: %+v", err)
+		}
+		return accessLog["http:req:header:authorization"]
+	}
+
+	assertAllowedOrigin("https://a.example.com", true)
+	assertAllowedOrigin("https://b.example.com", false)
+	if authorization := accessLogAuthorization(); authorization.([]interface{})[0] != redactedValue {
+		t.Errorf("Expected authorization header to be redacted, got %v", authorization)
+	}
+
+	// Invalid configurations must be rejected, keeping the current configuration in effect
+	current := reloadable.Get()
+	if err := os.WriteFile(path, []byte("http:\n  cors:\n    allowed-origins: [\"not an origin\"]\n"), 0600); err != nil {
+		t.Fatalf("Failed writing config file: %+v", err)
+	} else if err := reloadable.Reload(); err == nil {
+		t.Fatalf("Expected invalid configuration to be rejected")
+	} else if reloadable.Get() != current {
+		t.Fatalf("Expected current configuration to remain in effect after rejected reload")
+	}
+
+	// File changes must be picked up automatically
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := reloadable.WatchFiles(ctx, path); err != nil {
+		t.Fatalf("Failed watching config file: %+v", err)
+	}
+	newConfig := `
+http:
+  cors:
+    allowed-origins: ["https://b.example.com"]
+  access-log:
+    redacted-headers: ["cookie"]
+`
+	if err := os.WriteFile(path, []byte(newConfig), 0600); err != nil {
+		t.Fatalf("Failed writing config file: %+v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for reloadable.Get() == current && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reloadable.Get() == current {
+		t.Fatalf("Expected configuration to be reloaded after file change")
+	}
+
+	assertAllowedOrigin("https://a.example.com", false)
+	assertAllowedOrigin("https://b.example.com", true)
+	if authorization := accessLogAuthorization(); authorization.([]interface{})[0] != "Bearer secret" {
+		t.Errorf("Expected authorization header to no longer be redacted, got %v", authorization)
+	}
+}
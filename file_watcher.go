@@ -0,0 +1,69 @@
+package webutil
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const fileWatchDebounce = 100 * time.Millisecond
+
+// watchFiles invokes the given callback whenever any of the given files changes, until the context is done. The
+// parent directories are watched rather than the files themselves, so that atomic replacements (e.g. by editors or
+// Kubernetes ConfigMap/Secret volume updates, which swap a "..data" symlink) are detected as well.
+func watchFiles(ctx context.Context, onChange func(), paths ...string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Chain(err, "failed creating file watcher")
+	}
+
+	targets := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			_ = watcher.Close()
+			return errors.Chain(err, "failed resolving path '%s'", path)
+		}
+		targets[absPath] = true
+		if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+			_ = watcher.Close()
+			return errors.Chain(err, "failed watching directory of '%s'", path)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(fileWatchDebounce)
+		timer.Stop()
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				} else if event.Op == fsnotify.Chmod {
+					continue
+				} else if targets[filepath.Clean(event.Name)] || strings.HasPrefix(filepath.Base(event.Name), "..") {
+					// Coalesce bursts of events (e.g. truncate followed by write) into a single notification
+					timer.Reset(fileWatchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Ctx(ctx).Error().Err(err).Msg("File watcher failed")
+			case <-timer.C:
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
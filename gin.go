@@ -1,16 +1,14 @@
 package webutil
 
 import (
-	"github.com/gin-contrib/requestid"
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
 //goland:noinspection GoUnusedExportedFunction
 func InitGinPackage(devMode bool) {
-	gin.DefaultWriter = log.Logger.Level(zerolog.TraceLevel)
-	gin.DefaultErrorWriter = log.Logger.Level(zerolog.ErrorLevel)
+	// Resolve log.Logger on every write, so gin's output follows runtime logger & level changes
+	gin.DefaultWriter = ginLogWriter{}
+	gin.DefaultErrorWriter = ginLogWriter{}
 	if devMode {
 		gin.SetMode(gin.DebugMode)
 	} else {
@@ -23,7 +21,7 @@ func NewGin() *gin.Engine {
 	router := gin.New()
 	router.ContextWithFallback = true
 	router.MaxMultipartMemory = 8 << 20
-	router.Use(requestid.New())
+	router.Use(CreateGinRequestIDMiddleware())
 	router.Use(GinAccessLogMiddleware)
 	return router
 }
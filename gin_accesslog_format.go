@@ -0,0 +1,227 @@
+package webutil
+
+import (
+	"fmt"
+	"github.com/secureworks/errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// CommonLogFormat is the NCSA Common Log Format template.
+	CommonLogFormat = `%h %l %u %t "%r" %>s %b`
+
+	// CombinedLogFormat is the NCSA Combined Log Format template.
+	CombinedLogFormat = `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`
+)
+
+type accessLogFormatDirective func(b *strings.Builder, r *accessLogRecord)
+
+type accessLogFormatter struct {
+	directives []accessLogFormatDirective
+	writer     io.Writer
+	mutex      sync.Mutex
+}
+
+// WithAccessLogFormat makes the access log middleware write a text line per request to the given writer, formatted
+// using the given Apache-style template (e.g. CommonLogFormat or CombinedLogFormat), instead of the JSON log entry.
+// Supported directives are %a, %b, %B, %D, %h, %H, %l, %m, %q, %r, %s, %>s, %t, %T, %u, %U, %v, %{NAME}i, %{NAME}o
+// and %%. Errors reported by handlers (see gin.Context.Error) are still logged through zerolog. Panics if the template
+// is invalid.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAccessLogFormat(w io.Writer, format string) AccessLogOption {
+	directives, err := parseAccessLogFormat(format)
+	if err != nil {
+		panic(err)
+	}
+	formatter := &accessLogFormatter{directives: directives, writer: w}
+	return func(s *accessLogSettings) { s.formatter = formatter }
+}
+
+func (f *accessLogFormatter) write(r *accessLogRecord) {
+	b := strings.Builder{}
+	for _, directive := range f.directives {
+		directive(&b, r)
+	}
+	b.WriteByte('\n')
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, _ = io.WriteString(f.writer, b.String())
+}
+
+func parseAccessLogFormat(format string) ([]accessLogFormatDirective, error) {
+	var directives []accessLogFormatDirective
+	literal := strings.Builder{}
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			s := literal.String()
+			directives = append(directives, func(b *strings.Builder, _ *accessLogRecord) { b.WriteString(s) })
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		} else if i+1 >= len(format) {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid access log format '%s': dangling '%%' at end", format))
+		}
+		i++
+
+		// Parse optional "{NAME}" argument
+		var argument string
+		if format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid access log format '%s': unterminated '{' at position %d", format, i))
+			}
+			argument = format[i+1 : i+end]
+			i += end + 1
+			if i >= len(format) {
+				return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid access log format '%s': missing directive after '{%s}'", format, argument))
+			}
+		}
+
+		// Apache's "final status" modifier is the only status we have
+		if format[i] == '>' && i+1 < len(format) && format[i+1] == 's' {
+			i++
+		}
+
+		if format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		directive, err := newAccessLogFormatDirective(format[i], argument)
+		if err != nil {
+			return nil, errors.Chain(err, "invalid access log format '%s'", format)
+		}
+		flushLiteral()
+		directives = append(directives, directive)
+	}
+	flushLiteral()
+	return directives, nil
+}
+
+func newAccessLogFormatDirective(verb byte, argument string) (accessLogFormatDirective, error) {
+	switch verb {
+	case 'a', 'h':
+		return func(b *strings.Builder, r *accessLogRecord) { b.WriteString(remoteHost(r.request)) }, nil
+	case 'b':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			if r.size <= 0 {
+				b.WriteByte('-')
+			} else {
+				b.WriteString(strconv.Itoa(r.size))
+			}
+		}, nil
+	case 'B':
+		return func(b *strings.Builder, r *accessLogRecord) { b.WriteString(strconv.Itoa(max0(r.size))) }, nil
+	case 'D':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			b.WriteString(strconv.FormatInt(r.duration.Microseconds(), 10))
+		}, nil
+	case 'H':
+		return func(b *strings.Builder, r *accessLogRecord) { b.WriteString(r.request.Proto) }, nil
+	case 'i':
+		if argument == "" {
+			return nil, errors.New("directive %i requires a header name")
+		}
+		return func(b *strings.Builder, r *accessLogRecord) { writeLogHeader(b, r.config, r.request.Header, argument) }, nil
+	case 'l':
+		return func(b *strings.Builder, _ *accessLogRecord) { b.WriteByte('-') }, nil
+	case 'm':
+		return func(b *strings.Builder, r *accessLogRecord) { b.WriteString(r.request.Method) }, nil
+	case 'o':
+		if argument == "" {
+			return nil, errors.New("directive %o requires a header name")
+		}
+		return func(b *strings.Builder, r *accessLogRecord) { writeLogHeader(b, r.config, r.headers, argument) }, nil
+	case 'q':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			if r.query != "" {
+				writeLogEscaped(b, "?"+r.query)
+			}
+		}, nil
+	case 'r':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			writeLogEscaped(b, r.request.Method+" "+r.requestURI+" "+r.request.Proto)
+		}, nil
+	case 's':
+		return func(b *strings.Builder, r *accessLogRecord) { b.WriteString(strconv.Itoa(r.status)) }, nil
+	case 't':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			b.WriteString(r.start.Format("[02/Jan/2006:15:04:05 -0700]"))
+		}, nil
+	case 'T':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			b.WriteString(strconv.FormatInt(int64(r.duration.Seconds()), 10))
+		}, nil
+	case 'u':
+		return func(b *strings.Builder, r *accessLogRecord) {
+			if r.user == "" {
+				b.WriteByte('-')
+			} else {
+				writeLogEscaped(b, r.user)
+			}
+		}, nil
+	case 'U':
+		return func(b *strings.Builder, r *accessLogRecord) { writeLogEscaped(b, r.request.URL.Path) }, nil
+	case 'v':
+		return func(b *strings.Builder, r *accessLogRecord) { writeLogEscaped(b, r.request.Host) }, nil
+	default:
+		return nil, errors.NewWithStackTrace(fmt.Sprintf("unsupported directive '%%%c'", verb))
+	}
+}
+
+func max0(v int) int {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	} else if r.RemoteAddr != "" {
+		return r.RemoteAddr
+	}
+	return "-"
+}
+
+// writeLogHeader writes the value of the given header, redacted like in JSON access logs.
+func writeLogHeader(b *strings.Builder, config *AccessLogConfig, headers http.Header, name string) {
+	if value := headers.Get(name); value == "" {
+		b.WriteByte('-')
+	} else if config.isHeaderRedacted(name) {
+		b.WriteString(redactedValue)
+	} else {
+		writeLogEscaped(b, value)
+	}
+}
+
+// writeLogEscaped writes the given value escaping quotes, backslashes & non-printable characters like Apache does, so
+// that client-controlled values cannot forge log lines or break field quoting.
+func writeLogEscaped(b *strings.Builder, value string) {
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == utf8.RuneError && size == 1, r < 0x20, r == 0x7f:
+			_, _ = fmt.Fprintf(b, "\\x%02x", value[i])
+		default:
+			b.WriteString(value[i : i+size])
+		}
+		i += size
+	}
+}
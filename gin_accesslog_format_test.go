@@ -0,0 +1,120 @@
+package webutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/secureworks/errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestGinAccessLogFormat(t *testing.T) {
+	RedactAccessLogHeader("X-Format-Test-Key")
+	testCases := map[string]struct {
+		format   string
+		setup    func(req *http.Request)
+		expected string
+	}{
+		"combined": {
+			format: CombinedLogFormat,
+			setup: func(req *http.Request) {
+				req.Header.Set("Referer", "https://example.com/")
+				req.Header.Set("User-Agent", "test-agent")
+				req.SetBasicAuth("jack", "secret")
+			},
+			expected: `^192\.0\.2\.1 - jack \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /items\?page=2 HTTP/1\.1" 201 5 "https://example\.com/" "test-agent"\n$`,
+		},
+		"common without user": {
+			format:   CommonLogFormat,
+			expected: `^192\.0\.2\.1 - - \[.+\] "GET /items\?page=2 HTTP/1\.1" 201 5\n$`,
+		},
+		"custom": {
+			format:   `%m %U%q %>s %B %Dus %{Content-Type}o %{X-Missing}i 100%%`,
+			expected: `^GET /items\?page=2 201 5 \d+us text/plain; charset=utf-8 - 100%\n$`,
+		},
+		"redacted headers": {
+			format: `%{Authorization}i %{X-Format-Test-Key}i %{User-Agent}i %{Set-Cookie}o`,
+			setup: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer s3cr3t")
+				req.Header.Set("X-Format-Test-Key", "s3cr3t")
+				req.Header.Set("User-Agent", "test-agent")
+			},
+			expected: `^\*{8} \*{8} test-agent -\n$`,
+		},
+		"escaping": {
+			format:   `"%{User-Agent}i"`,
+			setup:    func(req *http.Request) { req.Header.Set("User-Agent", "evil\" agent\\\x01") },
+			expected: `^"evil\\" agent\\\\\\x01"\n$`,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			engine := gin.New()
+			engine.Use(CreateGinAccessLogMiddleware(WithAccessLogFormat(&buffer, tc.format)))
+			engine.GET("/items", func(c *gin.Context) { c.String(http.StatusCreated, "hello") })
+
+			req := httptest.NewRequest(http.MethodGet, "/items?page=2", nil)
+			if tc.setup != nil {
+				tc.setup(req)
+			}
+			engine.ServeHTTP(httptest.NewRecorder(), req)
+			if !regexp.MustCompile(tc.expected).MatchString(buffer.String()) {
+				t.Errorf("Expected access log line to match '%s', got: %q", tc.expected, buffer.String())
+			}
+		})
+	}
+}
+
+func TestInvalidAccessLogFormat(t *testing.T) {
+	for _, format := range []string{"%", "%Z", "%{Referer", "%i", "%{Referer}"} {
+		if _, err := parseAccessLogFormat(format); err == nil {
+			t.Errorf("Expected format '%s' to be rejected", format)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected invalid format to panic")
+		}
+	}()
+	WithAccessLogFormat(&bytes.Buffer{}, "%Z")
+}
+
+func TestGinAccessLogFormatErrors(t *testing.T) {
+	buffer, logBuffer := bytes.Buffer{}, bytes.Buffer{}
+	logger := zerolog.New(&logBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(CreateGinAccessLogMiddleware(WithAccessLogFormat(&buffer, `%m %U %>s`)))
+	engine.GET("/ok", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	engine.GET("/failed", func(c *gin.Context) {
+		_ = c.AbortWithError(http.StatusInternalServerError, errors.New("boom"))
+	})
+
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	if buffer.String() != "GET /ok 204\n" {
+		t.Errorf("Expected access log line, got: %q", buffer.String())
+	} else if logBuffer.Len() != 0 {
+		t.Errorf("Expected no log entries for successful requests, got: %s", logBuffer.String())
+	}
+
+	buffer.Reset()
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/failed", nil))
+	if buffer.String() != "GET /failed 500\n" {
+		t.Errorf("Expected access log line, got: %q", buffer.String())
+	}
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(logBuffer.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a log entry for the failed request, got: %s", logBuffer.String())
+	} else if entry["error"] != "boom" || entry["level"] != "error" || entry["http:req:requestURI"] != "/failed" {
+		t.Errorf("Expected error log entry of the failed request, got: %s", logBuffer.String())
+	}
+}
@@ -1,93 +1,433 @@
 package webutil
 
 import (
-	"bytes"
-	"github.com/gin-contrib/requestid"
+	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"io"
+	"github.com/secureworks/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-type customReadCloser struct {
-	r io.Reader
+const accessLogFieldsKey = "webutil:accessLog:fields"
+
+// StatusClientClosedRequest is the (non-standard, nginx-originated) status logged for requests whose client went away
+// before the response was delivered.
+const StatusClientClosedRequest = 499
+
+// SetAccessLogField adds a field to the access log entry that GinAccessLogMiddleware will emit for this request.
+func SetAccessLogField(c *gin.Context, key string, value interface{}) {
+	if v, ok := c.Get(accessLogFieldsKey); ok {
+		v.(map[string]interface{})[key] = value
+	} else {
+		c.Set(accessLogFieldsKey, map[string]interface{}{key: value})
+	}
 }
 
-func (rc *customReadCloser) Read(p []byte) (int, error) {
-	return rc.r.Read(p)
+type AccessLogConfig struct {
+	ExcludedHeaderPrefixes  []string      `env:"EXCLUDED_HEADER_PREFIXES" value-name:"PREFIX" long:"excluded-header-prefixes" description:"Prefixes of HTTP headers to omit from access logs" default:"sec-"`
+	RedactedHeaders         []string      `env:"REDACTED_HEADERS" value-name:"NAME" long:"redacted-headers" description:"HTTP headers whose values are redacted in access logs" default:"authorization" default:"cookie" default:"proxy-authorization" default:"set-cookie" default:"x-api-key"`
+	RedactedQueryParameters []string      `env:"REDACTED_QUERY_PARAMETERS" value-name:"NAME" long:"redacted-query-parameters" description:"Query parameters whose values are redacted in access logs" default:"access_token"`
+	FieldNaming             string        `env:"FIELD_NAMING" value-name:"SCHEME" long:"field-naming" description:"Naming scheme of access log fields" choice:"default" choice:"ecs" choice:"otel" default:"default"`
+	NestedFields            bool          `env:"NESTED_FIELDS" long:"nested-fields" description:"Emit access log fields as nested objects instead of flat keys"`
+	SlowRequestThreshold    time.Duration `env:"SLOW_REQUEST_THRESHOLD" value-name:"DURATION" long:"slow-request-threshold" description:"Log requests taking longer than this at warn level (zero to disable)"`
+	SlowRouteThresholds     []string      `env:"SLOW_ROUTE_THRESHOLDS" value-name:"[METHOD ]ROUTE=DURATION" long:"slow-route-thresholds" description:"Slow request thresholds of specific route templates (e.g. 'GET /items/:id=250ms')"`
+	SlowRequestStack        bool          `env:"SLOW_REQUEST_STACK" long:"slow-request-stack" description:"Capture the stack of slow requests while they are still running (at most once every 10 seconds)"`
+	PrincipalClaims         []string      `env:"PRINCIPAL_CLAIMS" value-name:"CLAIM" long:"principal-claims" description:"Claims of the authenticated principal to log" default:"sub" default:"azp" default:"client_id" default:"gty" default:"scope" default:"org_id"`
+	HashedPrincipalClaims   []string      `env:"HASHED_PRINCIPAL_CLAIMS" value-name:"CLAIM" long:"hashed-principal-claims" description:"Claims of the authenticated principal to log as keyed hashes (e.g. PII such as email); requires a principal hash key"`
+	PrincipalHashKey        string        `env:"PRINCIPAL_HASH_KEY" value-name:"KEY" long:"principal-hash-key" description:"Secret key for hashing principal claims with HMAC-SHA256" secret:"true"`
 }
 
-func (rc *customReadCloser) Close() error {
-	if closer, ok := rc.r.(io.Closer); ok {
-		return closer.Close()
-	} else {
-		return nil
+var defaultAccessLogConfig = AccessLogConfig{
+	ExcludedHeaderPrefixes:  []string{"sec-"},
+	RedactedHeaders:         []string{"authorization", "cookie", "proxy-authorization", "set-cookie", "x-api-key"},
+	RedactedQueryParameters: []string{"access_token"},
+	FieldNaming:             "default",
+	PrincipalClaims:         []string{"sub", "azp", "client_id", "gty", "scope", "org_id"},
+}
+
+func (c *AccessLogConfig) Validate() error {
+	if _, ok := accessLogFieldNamings[c.FieldNaming]; !ok {
+		return errors.NewWithStackTrace(fmt.Sprintf("unknown access log field naming scheme '%s'", c.FieldNaming))
+	} else if _, err := c.parseSlowRequestThresholds(); err != nil {
+		return err
+	} else if len(c.HashedPrincipalClaims) > 0 && c.PrincipalHashKey == "" {
+		return errors.New("a principal hash key is required for hashing principal claims")
 	}
+	return nil
 }
 
-func GinAccessLogMiddleware(c *gin.Context) {
-	// Create the logger event which we will start adding request & response data to
-	event := log.Ctx(c.Request.Context()).With()
+func (c *AccessLogConfig) isHeaderExcluded(name string) bool {
+	for _, prefix := range c.ExcludedHeaderPrefixes {
+		if strings.HasPrefix(name, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Add common request data
-	event = event.
-		Str("request:id", requestid.Get(c)).
-		Str("http:req:host", c.Request.Host).
-		Str("http:req:method", c.Request.Method).
-		Str("http:req:proto", c.Request.Proto).
-		Str("http:req:remoteAddr", c.Request.RemoteAddr).
-		Str("http:req:requestURI", c.Request.RequestURI)
+// registeredRedactedHeaders & registeredRedactedQueryParameters hold the (lower-cased) names of headers & query
+// parameters carrying credentials, registered by the middlewares reading them. They are redacted in access logs
+// regardless of configuration.
+var (
+	registeredRedactedHeaders         sync.Map
+	registeredRedactedQueryParameters sync.Map
+)
+
+// RedactAccessLogHeader makes access logs redact the values of the given header, in addition to the configured
+// RedactedHeaders. Authentication middlewares reading credentials from custom headers should call it.
+func RedactAccessLogHeader(name string) {
+	registeredRedactedHeaders.Store(strings.ToLower(name), true)
+}
 
-	// Add transfer encoding
-	if len(c.Request.TransferEncoding) > 0 {
-		transferEncoding := zerolog.Arr()
-		for _, encoding := range c.Request.TransferEncoding {
-			transferEncoding = transferEncoding.Str(encoding)
+// RedactAccessLogQueryParameter makes access logs redact the values of the given query parameter, in addition to the
+// configured RedactedQueryParameters. Authentication middlewares reading credentials from the query string should call
+// it.
+func RedactAccessLogQueryParameter(name string) {
+	registeredRedactedQueryParameters.Store(strings.ToLower(name), true)
+}
+
+func (c *AccessLogConfig) isHeaderRedacted(name string) bool {
+	for _, redacted := range c.RedactedHeaders {
+		if strings.EqualFold(name, redacted) {
+			return true
 		}
-		event = event.Array("http:req:transferEncoding", transferEncoding)
 	}
+	_, ok := registeredRedactedHeaders.Load(strings.ToLower(name))
+	return ok
+}
 
-	// Add headers (excluding some)
-	for name, values := range c.Request.Header {
-		name = strings.ToLower(name)
-		if strings.HasPrefix(name, "sec-") {
-			continue
+func (c *AccessLogConfig) isQueryParameterRedacted(name string) bool {
+	for _, redacted := range c.RedactedQueryParameters {
+		if strings.EqualFold(name, redacted) {
+			return true
 		}
-		arr := zerolog.Arr()
-		for _, value := range values {
-			arr.Str(value)
+	}
+	_, ok := registeredRedactedQueryParameters.Load(strings.ToLower(name))
+	return ok
+}
+
+// redactQuery returns the given raw query string with the values of redacted query parameters replaced, preserving
+// everything else as sent by the client.
+func (c *AccessLogConfig) redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	redacted := false
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if c.isQueryParameterRedacted(name) {
+			params[i] = key + "=" + redactedValue
+			redacted = true
 		}
-		event = event.Array("http:req:header:"+name, arr)
 	}
+	if !redacted {
+		return rawQuery
+	}
+	return strings.Join(params, "&")
+}
+
+// redactRequestURI returns the given request URI with the values of redacted query parameters replaced.
+func (c *AccessLogConfig) redactRequestURI(requestURI string) string {
+	if path, query, ok := strings.Cut(requestURI, "?"); ok {
+		return path + "?" + c.redactQuery(query)
+	}
+	return requestURI
+}
 
-	// Add trailer headers (excluding some)
-	for name, values := range c.Request.Trailer {
+func (c *AccessLogConfig) headerFields(prefix string, headers http.Header) []accessLogField {
+	var fields []accessLogField
+	for name, values := range headers {
 		name = strings.ToLower(name)
-		if strings.HasPrefix(name, "sec-") {
+		if c.isHeaderExcluded(name) {
 			continue
 		}
-		arr := zerolog.Arr()
-		for _, value := range values {
-			arr.Str(value)
+		logged := make([]string, len(values))
+		for i, value := range values {
+			if c.isHeaderRedacted(name) {
+				logged[i] = redactedValue
+			} else {
+				logged[i] = value
+			}
 		}
-		event = event.Array("http:req:trailer:"+name, arr)
+		fields = append(fields, accessLogField{key: prefix + name, value: logged})
 	}
+	return fields
+}
 
-	// Keep a copy of the request body
-	requestBody := bytes.Buffer{}
-	c.Request.Body = &customReadCloser{r: io.TeeReader(c.Request.Body, &requestBody)}
+type accessLogField struct {
+	key   string
+	value interface{}
+}
 
-	// Replace the request context with a context that references our logger (and revert immediately after)
+// accessLogRecord holds the data collected by the access log middleware for a single request.
+type accessLogRecord struct {
+	config     *AccessLogConfig
+	request    *http.Request
+	requestURI string // redacted
+	query      string // redacted
+	user       string
+	start      time.Time
+	duration   time.Duration
+	status     int
+	size       int
+	headers    http.Header
+	fields     map[string]interface{}
+}
+
+func (r *accessLogRecord) requestFields(config *AccessLogConfig) []accessLogField {
+	req := r.request
+	fields := []accessLogField{
+		{"request:id", RequestIDFromContext(req.Context())},
+		{"http:req:host", req.Host},
+		{"http:req:method", req.Method},
+		{"http:req:proto", req.Proto},
+		{"http:req:protoVersion", fmt.Sprintf("%d.%d", req.ProtoMajor, req.ProtoMinor)},
+		{"http:req:remoteAddr", req.RemoteAddr},
+		{"http:req:requestURI", r.requestURI},
+		{"http:req:path", req.URL.Path},
+		{"http:req:query", r.query},
+	}
+	if len(req.TransferEncoding) > 0 {
+		fields = append(fields, accessLogField{"http:req:transferEncoding", req.TransferEncoding})
+	}
+	if subject := TLSClientSubject(req); subject != "" {
+		fields = append(fields, accessLogField{"tls:client:subject", subject})
+	}
+	fields = append(fields, config.headerFields("http:req:header:", req.Header)...)
+	fields = append(fields, config.headerFields("http:req:trailer:", req.Trailer)...)
+	return fields
+}
+
+func (r *accessLogRecord) responseFields(config *AccessLogConfig) []accessLogField {
+	fields := []accessLogField{
+		{"http:process:duration", r.duration},
+		{"http:process:durationNanos", r.duration.Nanoseconds()},
+		{"http:process:durationSeconds", r.duration.Seconds()},
+		{"http:res:status", r.status},
+		{"http:res:size", r.size},
+	}
+	keys := make([]string, 0, len(r.fields))
+	for key := range r.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, accessLogField{key, r.fields[key]})
+	}
+	return append(fields, config.headerFields("http:res:header:", r.headers)...)
+}
+
+type accessLogSettings struct {
+	config         func() *AccessLogConfig
+	naming         AccessLogFieldNaming
+	formatter      *accessLogFormatter
+	slowThresholds atomic.Pointer[slowRequestThresholds]
+}
+
+type AccessLogOption func(*accessLogSettings)
+
+// WithAccessLogConfig makes the access log middleware read its settings through the given function on every request,
+// e.g. from a ReloadableConfig.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAccessLogConfig(config func() *AccessLogConfig) AccessLogOption {
+	return func(s *accessLogSettings) { s.config = config }
+}
+
+// WithAccessLogFieldNaming makes the access log middleware name fields using the given scheme, instead of the one
+// selected by its configuration.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAccessLogFieldNaming(naming AccessLogFieldNaming) AccessLogOption {
+	return func(s *accessLogSettings) { s.naming = naming }
+}
+
+var defaultGinAccessLogMiddleware = CreateGinAccessLogMiddleware()
+
+func GinAccessLogMiddleware(c *gin.Context) {
+	defaultGinAccessLogMiddleware(c)
+}
+
+func CreateGinAccessLogMiddleware(options ...AccessLogOption) gin.HandlerFunc {
+	settings := &accessLogSettings{config: func() *AccessLogConfig { return &defaultAccessLogConfig }}
+	for _, option := range options {
+		option(settings)
+	}
+	return func(c *gin.Context) {
+		settings.handle(c)
+	}
+}
+
+func (s *accessLogSettings) fieldNaming(config *AccessLogConfig) AccessLogFieldNaming {
+	if s.naming != nil {
+		return s.naming
+	} else if naming, ok := accessLogFieldNamings[config.FieldNaming]; ok {
+		return naming
+	}
+	return DefaultAccessLogFieldNaming
+}
+
+// appendFields names the given fields and adds them to the given logger context, either as flat keys or as nested
+// objects.
+func (s *accessLogSettings) appendFields(event zerolog.Context, config *AccessLogConfig, naming AccessLogFieldNaming, fields []accessLogField) zerolog.Context {
+	if config.NestedFields {
+		root := make(map[string]interface{})
+		for _, field := range fields {
+			if name := naming.FieldName(field.key); name != "" {
+				setNestedAccessLogField(root, strings.Split(name, naming.Separator()), field.value)
+			}
+		}
+		return event.Fields(root)
+	}
+
+	for _, field := range fields {
+		if name := naming.FieldName(field.key); name != "" {
+			event = appendAccessLogField(event, name, field.value)
+		}
+	}
+	return event
+}
+
+func appendAccessLogField(event zerolog.Context, name string, value interface{}) zerolog.Context {
+	switch v := value.(type) {
+	case string:
+		return event.Str(name, v)
+	case []string:
+		return event.Strs(name, v)
+	case int:
+		return event.Int(name, v)
+	case int64:
+		return event.Int64(name, v)
+	case float64:
+		return event.Float64(name, v)
+	case bool:
+		return event.Bool(name, v)
+	case time.Duration:
+		return event.Dur(name, v)
+	case []error:
+		return event.Errs(name, v)
+	default:
+		return event.Interface(name, v)
+	}
+}
+
+// nestedAccessLogLeafKey holds the value of a field whose name is also the prefix of other fields in nested access
+// logs, e.g. the value of "a:b" when "a:b:c" is also set.
+const nestedAccessLogLeafKey = "_value"
+
+func setNestedAccessLogField(node map[string]interface{}, path []string, value interface{}) {
+	for _, segment := range path[:len(path)-1] {
+		child, ok := node[segment].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			if leaf, exists := node[segment]; exists {
+				child[nestedAccessLogLeafKey] = leaf
+			}
+			node[segment] = child
+		}
+		node = child
+	}
+
+	// Render values the way zerolog would have rendered them as flat fields
+	switch v := value.(type) {
+	case time.Duration:
+		if zerolog.DurationFieldInteger {
+			value = int64(v / zerolog.DurationFieldUnit)
+		} else {
+			value = float64(v) / float64(zerolog.DurationFieldUnit)
+		}
+	case []error:
+		messages := make([]string, len(v))
+		for i, err := range v {
+			messages[i] = err.Error()
+		}
+		value = messages
+	}
+	if child, ok := node[path[len(path)-1]].(map[string]interface{}); ok {
+		child[nestedAccessLogLeafKey] = value
+	} else {
+		node[path[len(path)-1]] = value
+	}
+}
+
+// isClientClosed checks whether the client went away before the response was delivered, based on the first error
+// encountered writing the response, or on the request context having been canceled before the response was committed.
+// Responses fully written before the context was canceled were delivered, and are not considered closed by the client.
+func isClientClosed(ctx context.Context, writer *errorRecordingResponseWriter) bool {
+	writeErr := writer.err
+	if writeErr == nil {
+		return errors.Is(ctx.Err(), context.Canceled) && (!writer.committed || writer.ctxDoneAtCommitted)
+	}
+	return errors.Is(writeErr, syscall.EPIPE) ||
+		errors.Is(writeErr, syscall.ECONNRESET) ||
+		errors.Is(writeErr, net.ErrClosed) ||
+		errors.Is(writeErr, context.Canceled) ||
+		strings.Contains(writeErr.Error(), "client disconnected")
+}
+
+func (s *accessLogSettings) handle(c *gin.Context) {
+	config := s.config()
+	naming := s.fieldNaming(config)
+	record := &accessLogRecord{
+		config:     config,
+		request:    c.Request,
+		requestURI: config.redactRequestURI(c.Request.RequestURI),
+		query:      config.redactQuery(c.Request.URL.RawQuery),
+	}
+	c.Set(accessLogRequestKey, &accessLogRequest{settings: s, config: config, naming: naming, record: record})
+
+	// Collect request data, which is also attached to the request-scoped logger
+	requestFields := record.requestFields(config)
 	origCtx := c.Request.Context()
-	newContextWithReqLogger := event.Logger().WithContext(origCtx)
-	c.Request = c.Request.WithContext(newContextWithReqLogger)
+	logger := log.Ctx(origCtx)
+	requestLogger := s.appendFields(logger.With(), config, naming, requestFields).Logger()
+
+	// Replace the request context with a context that references our logger (and revert immediately after)
+	c.Request = c.Request.WithContext(requestLogger.WithContext(origCtx))
+
+	// Snapshot the stack of slow requests while they are still running, if requested
+	threshold := s.slowRequestThresholds(config).thresholdFor(c)
+	var stack atomic.Pointer[string]
+	var stackTimer *time.Timer
+	if threshold > 0 && config.SlowRequestStack {
+		if id := currentGoroutineID(); id != "" {
+			stackTimer = time.AfterFunc(threshold, func() {
+				if allowSlowRequestStack(time.Now()) {
+					snapshot := goroutineStack(id)
+					stack.Store(&snapshot)
+				}
+			})
+		}
+	}
+
+	// Record write errors (e.g. broken pipes) for client disconnect detection (and restore the writer immediately after)
+	origWriter := c.Writer
+	writer := &errorRecordingResponseWriter{ResponseWriter: origWriter, ctx: origCtx}
+	c.Writer = writer
 
 	// Invoke & time the next handler
-	start := time.Now()
+	record.start = time.Now()
 	c.Next()
-	duration := time.Since(start)
+	record.duration = time.Since(record.start)
+	c.Writer = origWriter
+	if stackTimer != nil {
+		stackTimer.Stop()
+	}
 
 	// Restore request context
 	c.Request = c.Request.WithContext(origCtx)
@@ -97,47 +437,78 @@ func GinAccessLogMiddleware(c *gin.Context) {
 		return
 	}
 
-	// Add invocation result
-	event = event.Dur("http:process:duration", duration)
-	event = event.Int("http:res:status", c.Writer.Status())
-	event = event.Int("http:res:size", c.Writer.Size())
-
-	// Add response headers
-	for name, values := range c.Writer.Header() {
-		if strings.HasPrefix(name, "sec-") {
-			continue
+	// Collect invocation result, including fields contributed by other middlewares & handlers
+	record.status = c.Writer.Status()
+	record.size = c.Writer.Size()
+	record.headers = c.Writer.Header()
+	clientClosed := isClientClosed(origCtx, writer)
+	if clientClosed {
+		SetAccessLogField(c, "http:res:originalStatus", record.status)
+		record.status = StatusClientClosedRequest
+		SetAccessLogField(c, "http:outcome", "client_closed")
+		if writer.err != nil {
+			SetAccessLogField(c, "http:res:writeError", writer.err.Error())
 		}
-		arr := zerolog.Arr()
-		for _, value := range values {
-			arr.Str(value)
+	}
+	slow := threshold > 0 && record.duration > threshold
+	if slow {
+		SetAccessLogField(c, "http:slow:detected", true)
+		SetAccessLogField(c, "http:slow:threshold", threshold)
+		if snapshot := stack.Load(); snapshot != nil && *snapshot != "" {
+			SetAccessLogField(c, "http:slow:stack", *snapshot)
 		}
-		event = event.Array("http:res:header:"+strings.ToLower(name), arr)
+	}
+	if fields, ok := c.Get(accessLogFieldsKey); ok {
+		record.fields = fields.(map[string]interface{})
+	}
+	if user, _, ok := c.Request.BasicAuth(); ok && record.user == "" {
+		record.user = user
 	}
 
-	// Add response errors
-	if len(c.Errors) > 0 {
-		var errorsArr []error
-		for _, err := range c.Errors {
-			errorsArr = append(errorsArr, err.Err)
-		}
-		event = event.Stack().Err(errorsArr[0])
-		if len(errorsArr) > 1 {
-			event = event.Errs("http:res:errors", errorsArr)
+	var errs []error
+	for _, err := range c.Errors {
+		errs = append(errs, err.Err)
+	}
+	responseFields := record.responseFields(config)
+	if len(errs) > 1 {
+		responseFields = append(responseFields, accessLogField{"http:res:errors", errs})
+	}
+	event := s.appendFields(logger.With(), config, naming, append(requestFields, responseFields...))
+	if len(errs) > 0 {
+		event = event.Stack().Err(errs[0])
+	}
+
+	// Write a formatted line instead of a JSON entry if requested, still logging errors (which the line cannot carry)
+	if s.formatter != nil {
+		s.formatter.write(record)
+		if len(errs) > 0 {
+			const failedMessage = "HTTP Request failed"
+			if entryLogger := event.Logger(); clientClosed {
+				entryLogger.Warn().Msg(failedMessage)
+			} else {
+				entryLogger.Error().Msg(failedMessage)
+			}
 		}
+		return
 	}
 
 	// Perform the logging with all the information we've added so far
 	const message = "HTTP Request processed"
-	logger := &([]zerolog.Logger{event.Logger()}[0])
-	if len(c.Errors) == 0 {
-		if c.Writer.Status() >= 200 && c.Writer.Status() <= 399 {
-			logger.Info().Msg(message)
-		} else if c.Writer.Status() >= 400 && c.Writer.Status() <= 499 {
-			logger.Warn().Msg(message)
+	entryLogger := event.Logger()
+	if clientClosed {
+		// Not a server error, regardless of any errors the handler reported due to the cancellation
+		entryLogger.Warn().Msg(message)
+	} else if len(errs) == 0 {
+		if record.status >= 200 && record.status <= 399 && !slow {
+			entryLogger.Info().Msg(message)
+		} else if record.status >= 200 && record.status <= 399 {
+			entryLogger.Warn().Msg(message)
+		} else if record.status >= 400 && record.status <= 499 {
+			entryLogger.Warn().Msg(message)
 		} else {
-			logger.Error().Msg(message)
+			entryLogger.Error().Msg(message)
 		}
 	} else {
-		logger.Error().Msg(message)
+		entryLogger.Error().Msg(message)
 	}
 }
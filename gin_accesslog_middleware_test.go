@@ -2,15 +2,20 @@ package webutil
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/secureworks/errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"regexp"
 	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -139,3 +144,267 @@ func TestGinAccessLogMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestGinAccessLogFieldNaming(t *testing.T) {
+	serve := func(t *testing.T, config *AccessLogConfig) map[string]interface{} {
+		t.Helper()
+		accessLogBuffer := bytes.Buffer{}
+		logger := zerolog.New(&accessLogBuffer)
+		engine := gin.New()
+		engine.Use(func(c *gin.Context) {
+			c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+			c.Next()
+		})
+		engine.Use(CreateGinAccessLogMiddleware(WithAccessLogConfig(func() *AccessLogConfig { return config })))
+		engine.GET("/items", func(c *gin.Context) {
+			SetAccessLogField(c, "http:res:error:code", "NOT_FOUND")
+			c.String(http.StatusNotFound, "nope")
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/items?page=2", nil)
+		req.Header.Set("User-Agent", "test-agent")
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+
+		accessLog := make(map[string]interface{})
+		if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+			t.Fatalf("Failed unmarshalling access log: %+v", err)
+		}
+		return accessLog
+	}
+	lookup := func(m map[string]interface{}, path ...string) interface{} {
+		var v interface{} = m
+		for _, segment := range path {
+			if node, ok := v.(map[string]interface{}); !ok {
+				return nil
+			} else {
+				v = node[segment]
+			}
+		}
+		return v
+	}
+
+	t.Run("ecs", func(t *testing.T) {
+		accessLog := serve(t, &AccessLogConfig{FieldNaming: "ecs"})
+		expected := map[string]interface{}{
+			"http.request.method":                "GET",
+			"http.version":                       "1.1",
+			"url.original":                       "/items?page=2",
+			"url.path":                           "/items",
+			"url.query":                          "page=2",
+			"http.response.status_code":          float64(404),
+			"http.response.body.bytes":           float64(4),
+			"error.code":                         "NOT_FOUND",
+			"http.request.headers.user-agent":    []interface{}{"test-agent"},
+			"http.response.headers.content-type": []interface{}{"text/plain; charset=utf-8"},
+		}
+		for key, value := range expected {
+			if actual, ok := accessLog[key]; !ok || fmt.Sprint(actual) != fmt.Sprint(value) {
+				t.Errorf("Expected '%s' to be '%v', got '%v'", key, value, actual)
+			}
+		}
+		if _, ok := accessLog["event.duration"].(float64); !ok {
+			t.Errorf("Expected 'event.duration' to be present, got: %+v", accessLog)
+		}
+		for _, key := range []string{"http:req:method", "http:req:proto", "http:process:duration"} {
+			if _, ok := accessLog[key]; ok {
+				t.Errorf("Expected '%s' to be omitted, got: %+v", key, accessLog)
+			}
+		}
+	})
+
+	t.Run("otel nested", func(t *testing.T) {
+		accessLog := serve(t, &AccessLogConfig{FieldNaming: "otel", NestedFields: true})
+		expected := map[string]interface{}{
+			"http.request.method":            "GET",
+			"network.protocol.version":       "1.1",
+			"url.path":                       "/items",
+			"http.response.status_code":      float64(404),
+			"http.response.body.size":        float64(4),
+			"error.type":                     "NOT_FOUND",
+			"http.request.header.user-agent": []interface{}{"test-agent"},
+		}
+		for key, value := range expected {
+			if actual := lookup(accessLog, strings.Split(key, ".")...); fmt.Sprint(actual) != fmt.Sprint(value) {
+				t.Errorf("Expected '%s' to be '%v', got '%v'", key, value, actual)
+			}
+		}
+		if _, ok := lookup(accessLog, "http", "server", "request", "duration").(float64); !ok {
+			t.Errorf("Expected nested request duration, got: %+v", accessLog)
+		}
+		if accessLog["message"] != "HTTP Request processed" || accessLog["level"] != "warn" {
+			t.Errorf("Expected level & message to remain top-level, got: %+v", accessLog)
+		}
+	})
+
+	t.Run("default nested", func(t *testing.T) {
+		accessLog := serve(t, &AccessLogConfig{FieldNaming: "default", NestedFields: true})
+		if method := lookup(accessLog, "http", "req", "method"); method != "GET" {
+			t.Errorf("Expected nested 'http:req:method' to be 'GET', got: %+v", accessLog)
+		}
+		if _, ok := lookup(accessLog, "http", "process", "duration").(float64); !ok {
+			t.Errorf("Expected nested 'http:process:duration', got: %+v", accessLog)
+		}
+		if lookup(accessLog, "http", "req", "path") != nil {
+			t.Errorf("Expected alternative fields to be omitted, got: %+v", accessLog)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		if err := (&AccessLogConfig{FieldNaming: "gelf"}).Validate(); err == nil {
+			t.Errorf("Expected unknown naming scheme to be rejected")
+		}
+	})
+}
+
+type brokenPipeResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *brokenPipeResponseWriter) Write([]byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+}
+
+func TestGinAccessLogClientClosed(t *testing.T) {
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(GinAccessLogMiddleware)
+	engine.GET("/", func(c *gin.Context) {
+		if err := c.Request.Context().Err(); err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.String(http.StatusOK, "Hello, World!")
+	})
+
+	accessLog := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(accessLogBuffer.Bytes(), &entry); err != nil {
+			t.Fatalf("Failed unmarshalling access log: %+v", err)
+		}
+		return entry
+	}
+	assertClientClosed := func(t *testing.T, entry map[string]interface{}) {
+		t.Helper()
+		if entry["http:outcome"] != "client_closed" || entry["http:res:status"] != float64(StatusClientClosedRequest) || entry["level"] != "warn" {
+			t.Errorf("Expected request to be logged as closed by client, got: %+v", entry)
+		}
+	}
+
+	t.Run("canceled context", func(t *testing.T) {
+		accessLogBuffer.Reset()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		entry := accessLog(t)
+		assertClientClosed(t, entry)
+		if entry["http:res:originalStatus"] != float64(http.StatusInternalServerError) {
+			t.Errorf("Expected original status to be logged, got: %+v", entry)
+		}
+	})
+
+	t.Run("canceled after response", func(t *testing.T) {
+		accessLogBuffer.Reset()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		engine.GET("/canceled-after-response", func(c *gin.Context) {
+			c.String(http.StatusCreated, "created")
+			cancel()
+		})
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/canceled-after-response", nil).WithContext(ctx))
+		if entry := accessLog(t); entry["http:outcome"] != nil || entry["http:res:status"] != float64(http.StatusCreated) {
+			t.Errorf("Expected response written before cancellation to be logged as is, got: %+v", entry)
+		}
+	})
+
+	t.Run("broken pipe", func(t *testing.T) {
+		accessLogBuffer.Reset()
+		engine.ServeHTTP(&brokenPipeResponseWriter{httptest.NewRecorder()}, httptest.NewRequest(http.MethodGet, "/", nil))
+		entry := accessLog(t)
+		assertClientClosed(t, entry)
+		if writeError, _ := entry["http:res:writeError"].(string); !strings.Contains(writeError, "broken pipe") {
+			t.Errorf("Expected write error to be logged, got: %+v", entry)
+		}
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		accessLogBuffer.Reset()
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if entry := accessLog(t); entry["http:outcome"] != nil || entry["http:res:status"] != float64(http.StatusOK) {
+			t.Errorf("Expected completed request not to be logged as closed by client, got: %+v", entry)
+		}
+	})
+}
+
+func TestGinAccessLogRedactedQueryParameters(t *testing.T) {
+	extractor := QueryParameterTokenExtractor("token")
+	serve := func(t *testing.T, naming AccessLogFieldNaming) string {
+		t.Helper()
+		accessLogBuffer := bytes.Buffer{}
+		logger := zerolog.New(&accessLogBuffer)
+		engine := gin.New()
+		engine.Use(func(c *gin.Context) {
+			c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+			c.Next()
+		})
+		engine.Use(CreateGinAccessLogMiddleware(WithAccessLogFieldNaming(naming)))
+		engine.GET("/events", func(c *gin.Context) {
+			if token, err := extractor(c.Request); err != nil || token != "s3cr3t" {
+				t.Errorf("Expected token 's3cr3t', got '%s' (%v)", token, err)
+			}
+			c.Status(http.StatusNoContent)
+		})
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events?page=2&token=s3cr3t&access_token=0th3r", nil))
+		return accessLogBuffer.String()
+	}
+	for name, naming := range map[string]AccessLogFieldNaming{"default": DefaultAccessLogFieldNaming, "ecs": ECSAccessLogFieldNaming, "otel": OTelAccessLogFieldNaming} {
+		naming := naming
+		t.Run(name, func(t *testing.T) {
+			accessLog := serve(t, naming)
+			if strings.Contains(accessLog, "s3cr3t") || strings.Contains(accessLog, "0th3r") {
+				t.Errorf("Access log contains a token: %s", accessLog)
+			} else if !strings.Contains(accessLog, "page=2&token=********&access_token=********") {
+				t.Errorf("Access log does not contain the redacted query: %s", accessLog)
+			}
+		})
+	}
+}
+
+func TestGinAccessLogNestedFieldPrefixes(t *testing.T) {
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	config := &AccessLogConfig{FieldNaming: "default", NestedFields: true}
+	engine.Use(CreateGinAccessLogMiddleware(WithAccessLogConfig(func() *AccessLogConfig { return config })))
+	engine.GET("/", func(c *gin.Context) {
+		SetAccessLogField(c, "app:flag", true)
+		SetAccessLogField(c, "app:flag:reason", "leaf first")
+		SetAccessLogField(c, "app:other:reason", "longer key first")
+		SetAccessLogField(c, "app:other", true)
+		c.Status(http.StatusNoContent)
+	})
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var accessLog struct {
+		App map[string]map[string]interface{} `json:"app"`
+	}
+	if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+		t.Fatalf("Failed unmarshalling access log: %+v", err)
+	}
+	expected := map[string]map[string]interface{}{
+		"flag":  {"_value": true, "reason": "leaf first"},
+		"other": {"_value": true, "reason": "longer key first"},
+	}
+	if fmt.Sprint(accessLog.App) != fmt.Sprint(expected) {
+		t.Errorf("Expected nested fields %v, got: %s", expected, accessLogBuffer.String())
+	}
+}
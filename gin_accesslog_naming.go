@@ -0,0 +1,123 @@
+package webutil
+
+import (
+	"strings"
+)
+
+// AccessLogFieldNaming names the fields emitted by the access log middleware.
+type AccessLogFieldNaming interface {
+	// FieldName returns the name to emit for the given field key, or an empty string to omit the field. Keys are the
+	// names emitted by DefaultAccessLogFieldNaming (e.g. "http:req:method", "http:req:header:user-agent"), as well as
+	// these alternative representations which it omits:
+	//   - "http:req:protoVersion": protocol version without the protocol name (e.g. "1.1")
+	//   - "http:req:path" & "http:req:query": request URL path & raw query
+	//   - "http:process:durationNanos" & "http:process:durationSeconds": duration as nanoseconds & seconds
+	FieldName(key string) string
+
+	// Separator returns the separator between path segments of field names, used to nest fields into objects.
+	Separator() string
+}
+
+type mappedAccessLogFieldNaming struct {
+	separator string
+	names     map[string]string
+	prefixes  [][2]string
+}
+
+func (n *mappedAccessLogFieldNaming) FieldName(key string) string {
+	if name, ok := n.names[key]; ok {
+		return name
+	}
+	for _, prefix := range n.prefixes {
+		if strings.HasPrefix(key, prefix[0]) {
+			return prefix[1] + key[len(prefix[0]):]
+		}
+	}
+	return strings.ReplaceAll(key, ":", n.separator)
+}
+
+func (n *mappedAccessLogFieldNaming) Separator() string {
+	return n.separator
+}
+
+// DefaultAccessLogFieldNaming emits fields using webutil's own colon-separated keys (e.g. "http:req:method").
+var DefaultAccessLogFieldNaming AccessLogFieldNaming = &mappedAccessLogFieldNaming{
+	separator: ":",
+	names: map[string]string{
+		"http:req:protoVersion":        "",
+		"http:req:path":                "",
+		"http:req:query":               "",
+		"http:process:durationNanos":   "",
+		"http:process:durationSeconds": "",
+	},
+}
+
+// ECSAccessLogFieldNaming emits fields using Elastic Common Schema names (e.g. "http.request.method", "url.path").
+var ECSAccessLogFieldNaming AccessLogFieldNaming = &mappedAccessLogFieldNaming{
+	separator: ".",
+	names: map[string]string{
+		"request:id":                   "http.request.id",
+		"http:req:host":                "url.domain",
+		"http:req:method":              "http.request.method",
+		"http:req:proto":               "",
+		"http:req:protoVersion":        "http.version",
+		"http:req:remoteAddr":          "client.address",
+		"http:req:requestURI":          "url.original",
+		"http:req:path":                "url.path",
+		"http:req:query":               "url.query",
+		"http:req:transferEncoding":    "http.request.transfer_encoding",
+		"tls:client:subject":           "tls.client.subject",
+		"http:process:duration":        "",
+		"http:process:durationNanos":   "event.duration",
+		"http:process:durationSeconds": "",
+		"http:res:status":              "http.response.status_code",
+		"http:res:size":                "http.response.body.bytes",
+		"http:res:error:code":          "error.code",
+		"auth:sub":                     "user.id",
+		"auth:email":                   "user.email",
+		"auth:org_id":                  "organization.id",
+	},
+	prefixes: [][2]string{
+		{"http:req:header:", "http.request.headers."},
+		{"http:req:trailer:", "http.request.trailers."},
+		{"http:res:header:", "http.response.headers."},
+	},
+}
+
+// OTelAccessLogFieldNaming emits fields using OpenTelemetry semantic conventions (e.g. "http.request.method",
+// "http.response.status_code").
+var OTelAccessLogFieldNaming AccessLogFieldNaming = &mappedAccessLogFieldNaming{
+	separator: ".",
+	names: map[string]string{
+		"request:id":                   "http.request.id",
+		"http:req:host":                "server.address",
+		"http:req:method":              "http.request.method",
+		"http:req:proto":               "",
+		"http:req:protoVersion":        "network.protocol.version",
+		"http:req:remoteAddr":          "client.address",
+		"http:req:requestURI":          "",
+		"http:req:path":                "url.path",
+		"http:req:query":               "url.query",
+		"tls:client:subject":           "tls.client.subject",
+		"http:process:duration":        "",
+		"http:process:durationNanos":   "",
+		"http:process:durationSeconds": "http.server.request.duration",
+		"http:res:status":              "http.response.status_code",
+		"http:res:size":                "http.response.body.size",
+		"http:res:error:code":          "error.type",
+		"auth:sub":                     "enduser.id",
+		"auth:scope":                   "enduser.scope",
+	},
+	prefixes: [][2]string{
+		{"http:req:header:", "http.request.header."},
+		{"http:req:trailer:", "http.request.trailer."},
+		{"http:res:header:", "http.response.header."},
+	},
+}
+
+var accessLogFieldNamings = map[string]AccessLogFieldNaming{
+	"":        DefaultAccessLogFieldNaming,
+	"default": DefaultAccessLogFieldNaming,
+	"ecs":     ECSAccessLogFieldNaming,
+	"otel":    OTelAccessLogFieldNaming,
+}
@@ -0,0 +1,120 @@
+package webutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+const accessLogRequestKey = "webutil:accessLog:request"
+
+// accessLogRequest is the state of the access log middleware for a single request, available to later middlewares.
+type accessLogRequest struct {
+	settings *accessLogSettings
+	config   *AccessLogConfig
+	naming   AccessLogFieldNaming
+	record   *accessLogRecord
+}
+
+// EnrichAccessLogPrincipal adds the configured claims of the authenticated principal in the request context (see
+// GetClaims) to the request-scoped logger and to the access log entry. Authentication middlewares in this package call
+// it automatically; custom ones should call it once the claims are in the request context.
+func EnrichAccessLogPrincipal(c *gin.Context) {
+	v, ok := c.Get(accessLogRequestKey)
+	if !ok {
+		return
+	}
+	state := v.(*accessLogRequest)
+
+	claims := GetClaims(c.Request.Context())
+	if claims == nil {
+		return
+	}
+	fields := state.config.principalFields(principalClaims(claims))
+	if len(fields) == 0 {
+		return
+	}
+	for _, field := range fields {
+		SetAccessLogField(c, field.key, field.value)
+	}
+	if claims.RegisteredClaims.Subject != "" {
+		state.record.user = claims.RegisteredClaims.Subject
+	}
+	log.Ctx(c.Request.Context()).UpdateContext(func(event zerolog.Context) zerolog.Context {
+		return state.settings.appendFields(event, state.config, state.naming, fields)
+	})
+}
+
+// principalClaims collects the registered & custom claims of the given validated claims into a single map, using their
+// JSON names.
+func principalClaims(claims *validator.ValidatedClaims) map[string]interface{} {
+	values := make(map[string]interface{})
+	if claims.CustomClaims != nil {
+		if data, err := json.Marshal(claims.CustomClaims); err == nil {
+			_ = json.Unmarshal(data, &values)
+		}
+	}
+	registered := claims.RegisteredClaims
+	for name, value := range map[string]string{"iss": registered.Issuer, "sub": registered.Subject, "jti": registered.ID} {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	if len(registered.Audience) > 0 {
+		values["aud"] = registered.Audience
+	}
+	return values
+}
+
+// principalFields returns the access log fields of the configured principal claims, hashing PII-sensitive ones.
+func (c *AccessLogConfig) principalFields(claims map[string]interface{}) []accessLogField {
+	hashed := make(map[string]bool, len(c.HashedPrincipalClaims))
+	for _, name := range c.HashedPrincipalClaims {
+		hashed[name] = true
+	}
+	names := append(append([]string{}, c.PrincipalClaims...), c.HashedPrincipalClaims...)
+	sort.Strings(names)
+
+	var fields []accessLogField
+	for i, name := range names {
+		value, ok := claims[name]
+		if !ok || value == nil || (i > 0 && names[i-1] == name) {
+			continue
+		}
+		if hashed[name] {
+			value = c.hashPrincipalClaim(value)
+		} else if values, ok := value.([]interface{}); ok {
+			strs := make([]string, 0, len(values))
+			for _, v := range values {
+				if s, ok := v.(string); ok {
+					strs = append(strs, s)
+				}
+			}
+			value = strs
+		}
+		fields = append(fields, accessLogField{key: "auth:" + name, value: value})
+	}
+	return fields
+}
+
+// hashPrincipalClaim returns a stable pseudonym of the given claim value, using HMAC-SHA256 keyed by PrincipalHashKey.
+// Unkeyed hashes of low-entropy values such as emails are easily reversed by dictionary attacks, so without a key the
+// value is redacted instead (Validate rejects such configurations).
+func (c *AccessLogConfig) hashPrincipalClaim(value interface{}) string {
+	if c.PrincipalHashKey == "" {
+		return redactedValue
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return redactedValue
+	}
+	h := hmac.New(sha256.New, []byte(c.PrincipalHashKey))
+	h.Write(data)
+	return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil)[:16])
+}
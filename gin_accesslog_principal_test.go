@@ -0,0 +1,134 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testPrincipalClaims struct {
+	Scope       string   `json:"scope,omitempty"`
+	AZP         string   `json:"azp,omitempty"`
+	GrantType   string   `json:"gty,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+func (c *testPrincipalClaims) Validate(context.Context) error { return nil }
+
+func TestEnrichAccessLogPrincipal(t *testing.T) {
+	config := defaultAccessLogConfig
+	config.PrincipalClaims = append(config.PrincipalClaims, "permissions")
+	config.HashedPrincipalClaims = []string{"email"}
+	config.PrincipalHashKey = "principal-hash-key"
+
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(CreateGinAccessLogMiddleware(WithAccessLogConfig(func() *AccessLogConfig { return &config })))
+	var claims *validator.ValidatedClaims
+	engine.Use(func(c *gin.Context) {
+		// Fake authentication middleware
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), jwtmiddleware.ContextKey{}, claims))
+		EnrichAccessLogPrincipal(c)
+	})
+	engine.GET("/", func(c *gin.Context) {
+		log.Ctx(c.Request.Context()).Info().Msg("handler message")
+		c.Status(http.StatusNoContent)
+	})
+
+	serve := func(t *testing.T) (handlerEntry, accessLogEntry map[string]interface{}) {
+		t.Helper()
+		accessLogBuffer.Reset()
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		lines := strings.Split(strings.TrimSpace(accessLogBuffer.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Expected handler & access log entries, got: %s", accessLogBuffer.String())
+		}
+		handlerEntry, accessLogEntry = make(map[string]interface{}), make(map[string]interface{})
+		if err := json.Unmarshal([]byte(lines[0]), &handlerEntry); err != nil {
+			t.Fatalf("Failed unmarshalling handler log entry: %+v", err)
+		} else if err := json.Unmarshal([]byte(lines[1]), &accessLogEntry); err != nil {
+			t.Fatalf("Failed unmarshalling access log entry: %+v", err)
+		}
+		return handlerEntry, accessLogEntry
+	}
+
+	t.Run("user", func(t *testing.T) {
+		claims = &validator.ValidatedClaims{
+			RegisteredClaims: validator.RegisteredClaims{Subject: "auth0|123"},
+			CustomClaims: &testPrincipalClaims{
+				Scope:       "read:items write:items",
+				AZP:         "spa-client",
+				Email:       "jack@example.com",
+				Permissions: []string{"read:items"},
+			},
+		}
+		handlerEntry, accessLogEntry := serve(t)
+		for _, entry := range []map[string]interface{}{handlerEntry, accessLogEntry} {
+			if entry["auth:sub"] != "auth0|123" || entry["auth:azp"] != "spa-client" || entry["auth:scope"] != "read:items write:items" {
+				t.Errorf("Expected principal claims to be logged, got: %+v", entry)
+			}
+			if permissions, _ := entry["auth:permissions"].([]interface{}); len(permissions) != 1 || permissions[0] != "read:items" {
+				t.Errorf("Expected permissions to be logged, got: %+v", entry)
+			}
+			if email, _ := entry["auth:email"].(string); !strings.HasPrefix(email, "hmac-sha256:") || strings.Contains(email, "jack") {
+				t.Errorf("Expected email to be hashed, got: %+v", entry)
+			}
+		}
+	})
+
+	t.Run("machine to machine", func(t *testing.T) {
+		claims = &validator.ValidatedClaims{
+			RegisteredClaims: validator.RegisteredClaims{Subject: "m2m-client@clients"},
+			CustomClaims:     &testPrincipalClaims{Scope: "sync:items", AZP: "m2m-client", GrantType: "client-credentials"},
+		}
+		_, accessLogEntry := serve(t)
+		if accessLogEntry["auth:sub"] != "m2m-client@clients" || accessLogEntry["auth:azp"] != "m2m-client" || accessLogEntry["auth:gty"] != "client-credentials" {
+			t.Errorf("Expected M2M principal to be logged, got: %+v", accessLogEntry)
+		}
+		if _, ok := accessLogEntry["auth:email"]; ok {
+			t.Errorf("Expected absent claims to be omitted, got: %+v", accessLogEntry)
+		}
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		claims = nil
+		_, accessLogEntry := serve(t)
+		for key := range accessLogEntry {
+			if strings.HasPrefix(key, "auth:") {
+				t.Errorf("Expected no principal fields for anonymous requests, got: %+v", accessLogEntry)
+			}
+		}
+	})
+}
+
+func TestHashPrincipalClaim(t *testing.T) {
+	keyed := &AccessLogConfig{PrincipalHashKey: "k"}
+	otherKey := &AccessLogConfig{PrincipalHashKey: "other"}
+	unkeyed := &AccessLogConfig{HashedPrincipalClaims: []string{"email"}}
+	if keyed.hashPrincipalClaim("a") != keyed.hashPrincipalClaim("a") {
+		t.Errorf("Expected hashes to be stable")
+	} else if keyed.hashPrincipalClaim("a") == keyed.hashPrincipalClaim("b") {
+		t.Errorf("Expected different values to hash differently")
+	} else if keyed.hashPrincipalClaim("a") == otherKey.hashPrincipalClaim("a") {
+		t.Errorf("Expected hashes to depend on the key")
+	} else if unkeyed.hashPrincipalClaim("a") != redactedValue {
+		t.Errorf("Expected values to be redacted rather than hashed without a key, got '%s'", unkeyed.hashPrincipalClaim("a"))
+	} else if err := unkeyed.Validate(); err == nil {
+		t.Errorf("Expected hashed principal claims without a key to be rejected")
+	}
+}
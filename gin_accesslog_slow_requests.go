@@ -0,0 +1,137 @@
+package webutil
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const goroutineStackMaxSize = 1 << 20
+
+var (
+	// slowRequestStackInterval is the minimum interval between stack snapshots of slow requests
+	slowRequestStackInterval = 10 * time.Second
+	lastSlowRequestStack     atomic.Int64
+)
+
+// slowRequestThresholds holds the parsed slow request thresholds of an AccessLogConfig.
+type slowRequestThresholds struct {
+	config    *AccessLogConfig
+	threshold time.Duration
+	routes    map[string]time.Duration
+}
+
+func (c *AccessLogConfig) parseSlowRequestThresholds() (*slowRequestThresholds, error) {
+	thresholds := &slowRequestThresholds{
+		config:    c,
+		threshold: c.SlowRequestThreshold,
+		routes:    make(map[string]time.Duration),
+	}
+	if c.SlowRequestThreshold < 0 {
+		return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid slow request threshold %s", c.SlowRequestThreshold))
+	}
+	for _, spec := range c.SlowRouteThresholds {
+		separator := strings.LastIndexByte(spec, '=')
+		if separator < 0 {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid slow route threshold '%s': expected '[METHOD ]ROUTE=DURATION'", spec))
+		}
+		route := strings.TrimSpace(spec[:separator])
+		if method, path, ok := strings.Cut(route, " "); ok {
+			route = strings.ToUpper(method) + " " + strings.TrimSpace(path)
+		}
+		if route == "" || !strings.Contains(route, "/") {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid slow route threshold '%s': missing route template", spec))
+		}
+		threshold, err := time.ParseDuration(strings.TrimSpace(spec[separator+1:]))
+		if err != nil || threshold < 0 {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid slow route threshold '%s': invalid duration", spec))
+		}
+		thresholds.routes[route] = threshold
+	}
+	return thresholds, nil
+}
+
+// thresholdFor returns the slow request threshold for the given request, preferring thresholds of its method & route
+// template over thresholds of its route template, over the default threshold.
+func (t *slowRequestThresholds) thresholdFor(c *gin.Context) time.Duration {
+	if route := c.FullPath(); route != "" {
+		if threshold, ok := t.routes[c.Request.Method+" "+route]; ok {
+			return threshold
+		} else if threshold, ok := t.routes[route]; ok {
+			return threshold
+		}
+	}
+	return t.threshold
+}
+
+// slowRequestThresholds returns the parsed thresholds of the given configuration, re-parsing only when the
+// configuration changes. Invalid thresholds (which Validate rejects) disable slow request detection.
+func (s *accessLogSettings) slowRequestThresholds(config *AccessLogConfig) *slowRequestThresholds {
+	if cached := s.slowThresholds.Load(); cached != nil && cached.config == config {
+		return cached
+	}
+	thresholds, err := config.parseSlowRequestThresholds()
+	if err != nil {
+		thresholds = &slowRequestThresholds{config: config}
+	}
+	s.slowThresholds.Store(thresholds)
+	return thresholds
+}
+
+// currentGoroutineID returns the ID of the calling goroutine, as printed in stack traces.
+func currentGoroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// Format is "goroutine 123 [running]:..."
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return ""
+	} else if _, err := strconv.ParseUint(string(fields[1]), 10, 64); err != nil {
+		return ""
+	}
+	return string(fields[1])
+}
+
+// goroutineStack returns the current stack of the goroutine with the given ID, or an empty string if it is not found.
+// Dumping all goroutines stops the world, so the dump is capped at goroutineStackMaxSize (goroutines beyond it are not
+// found), and callers should rate-limit it (see allowSlowRequestStack).
+func goroutineStack(id string) string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= goroutineStackMaxSize {
+			buf = buf[:n]
+			break
+		}
+		size := len(buf) * 2
+		if size > goroutineStackMaxSize {
+			size = goroutineStackMaxSize
+		}
+		buf = make([]byte, size)
+	}
+
+	header := []byte("goroutine " + id + " [")
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return string(stack)
+		}
+	}
+	return ""
+}
+
+// allowSlowRequestStack reports whether a stack snapshot may be taken now, allowing at most one per
+// slowRequestStackInterval across the process, so that an overloaded process (where most requests are slow) is not
+// slowed down further by repeated stop-the-world stack dumps.
+func allowSlowRequestStack(now time.Time) bool {
+	last := lastSlowRequestStack.Load()
+	if last != 0 && now.Sub(time.Unix(0, last)) < slowRequestStackInterval {
+		return false
+	}
+	return lastSlowRequestStack.CompareAndSwap(last, now.UnixNano())
+}
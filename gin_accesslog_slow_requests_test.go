@@ -0,0 +1,101 @@
+package webutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func slowTestHandler(c *gin.Context) {
+	time.Sleep(100 * time.Millisecond)
+	c.Status(http.StatusOK)
+}
+
+func TestGinAccessLogSlowRequests(t *testing.T) {
+	// Snapshot the stack of every slow request
+	defer func(interval time.Duration) { slowRequestStackInterval = interval }(slowRequestStackInterval)
+	slowRequestStackInterval = 0
+
+	config := &AccessLogConfig{
+		FieldNaming:          "default",
+		SlowRequestThreshold: time.Minute,
+		SlowRouteThresholds:  []string{"GET /items/:id=10ms", "/other/:id=10ms"},
+		SlowRequestStack:     true,
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected config to be valid: %+v", err)
+	}
+
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(CreateGinAccessLogMiddleware(WithAccessLogConfig(func() *AccessLogConfig { return config })))
+	engine.GET("/items/:id", slowTestHandler)
+	engine.POST("/items/:id", slowTestHandler)
+	engine.GET("/other/:id", slowTestHandler)
+	engine.GET("/fast", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	testCases := map[string]struct {
+		method, path string
+		expectSlow   bool
+	}{
+		"method & route threshold": {method: http.MethodGet, path: "/items/1", expectSlow: true},
+		"other method":             {method: http.MethodPost, path: "/items/1", expectSlow: false},
+		"route threshold":          {method: http.MethodGet, path: "/other/1", expectSlow: true},
+		"default threshold":        {method: http.MethodGet, path: "/fast", expectSlow: false},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			accessLogBuffer.Reset()
+			engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tc.method, tc.path, nil))
+
+			accessLog := make(map[string]interface{})
+			if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+				t.Fatalf("Failed unmarshalling access log: %+v", err)
+			}
+			if tc.expectSlow {
+				if accessLog["http:slow:detected"] != true || accessLog["level"] != "warn" {
+					t.Errorf("Expected slow request to be logged at warn, got: %+v", accessLog)
+				}
+				if stack, _ := accessLog["http:slow:stack"].(string); !strings.Contains(stack, "slowTestHandler") {
+					t.Errorf("Expected stack snapshot of the running handler, got: %s", stack)
+				}
+			} else if _, ok := accessLog["http:slow:detected"]; ok || accessLog["level"] != "info" {
+				t.Errorf("Expected request not to be considered slow, got: %+v", accessLog)
+			}
+		})
+	}
+}
+
+func TestSlowRouteThresholdsValidation(t *testing.T) {
+	for _, spec := range []string{"GET /items", "/items=fast", "=10ms", "GET=10ms", "/items=-1s"} {
+		if err := (&AccessLogConfig{SlowRouteThresholds: []string{spec}}).Validate(); err == nil {
+			t.Errorf("Expected slow route threshold '%s' to be rejected", spec)
+		}
+	}
+}
+
+func TestAllowSlowRequestStack(t *testing.T) {
+	defer func(last int64) { lastSlowRequestStack.Store(last) }(lastSlowRequestStack.Load())
+	lastSlowRequestStack.Store(0)
+
+	now := time.Now()
+	if !allowSlowRequestStack(now) {
+		t.Fatalf("Expected first stack snapshot to be allowed")
+	} else if allowSlowRequestStack(now.Add(slowRequestStackInterval - time.Millisecond)) {
+		t.Errorf("Expected stack snapshot within the interval to be rejected")
+	} else if !allowSlowRequestStack(now.Add(slowRequestStackInterval)) {
+		t.Errorf("Expected stack snapshot after the interval to be allowed")
+	}
+}
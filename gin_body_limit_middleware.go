@@ -0,0 +1,93 @@
+package webutil
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+const maxBodySizeReaderKey = "webutil:maxBodySize:reader"
+
+type maxBytesReadCloser struct {
+	body     io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (r *maxBytesReadCloser) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, &http.MaxBytesError{Limit: r.limit}
+	} else if r.limit <= 0 {
+		n, err := r.body.Read(p)
+		r.read += int64(n)
+		return n, err
+	}
+
+	// Read one byte more than allowed, so we can tell a body of exactly the limit from one that exceeds it
+	if remaining := r.limit - r.read; remaining < 0 {
+		r.exceeded = true
+		return 0, &http.MaxBytesError{Limit: r.limit}
+	} else if int64(len(p)) > remaining+1 {
+		p = p[:remaining+1]
+	}
+
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		r.exceeded = true
+		return n - int(r.read-r.limit), &http.MaxBytesError{Limit: r.limit}
+	}
+	return n, err
+}
+
+func (r *maxBytesReadCloser) Close() error {
+	return r.body.Close()
+}
+
+func abortWithRequestBodyTooLarge(c *gin.Context, limit int64) {
+	SetAccessLogField(c, "http:req:bodyLimit", limit)
+	SetAccessLogField(c, "http:req:bodyLimitExceeded", true)
+	if !c.Writer.Written() {
+		AbortWithErrorResponse(c,
+			http.StatusRequestEntityTooLarge,
+			"REQUEST_BODY_TOO_LARGE",
+			fmt.Sprintf("Request body must not exceed %d bytes.", limit))
+	} else {
+		c.Abort()
+	}
+}
+
+// CreateGinMaxBodySizeMiddleware limits request bodies to the given number of bytes (zero or less means no limit).
+// When installed both globally and on route groups, the smallest applicable limit wins.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinMaxBodySizeMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit > 0 && c.Request.ContentLength > limit {
+			abortWithRequestBodyTooLarge(c, limit)
+			return
+		}
+
+		// If an outer middleware already limits the body, just narrow its limit
+		if v, ok := c.Get(maxBodySizeReaderKey); ok {
+			if reader := v.(*maxBytesReadCloser); limit > 0 && (reader.limit <= 0 || limit < reader.limit) {
+				reader.limit = limit
+			}
+			c.Next()
+			return
+		} else if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		reader := &maxBytesReadCloser{body: c.Request.Body, limit: limit}
+		c.Request.Body = reader
+		c.Set(maxBodySizeReaderKey, reader)
+		c.Next()
+		if reader.exceeded {
+			abortWithRequestBodyTooLarge(c, reader.limit)
+		}
+	}
+}
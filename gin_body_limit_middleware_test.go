@@ -0,0 +1,107 @@
+package webutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chunkedReader hides the body length from the request, forcing the limit to be enforced while streaming
+type chunkedReader struct {
+	r io.Reader
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestMaxBodySizeMiddleware(t *testing.T) {
+	engine := gin.New()
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(GinAccessLogMiddleware)
+	engine.Use(CreateGinMaxBodySizeMiddleware(10))
+	echo := func(c *gin.Context) {
+		if body, err := io.ReadAll(c.Request.Body); err == nil {
+			c.String(http.StatusOK, string(body))
+		}
+	}
+	engine.POST("/", echo)
+	engine.Group("/small", CreateGinMaxBodySizeMiddleware(5)).POST("", echo)
+
+	cases := []struct {
+		path           string
+		body           io.Reader
+		expectedStatus int
+	}{
+		{"/", strings.NewReader("0123456789"), http.StatusOK},
+		{"/", strings.NewReader("0123456789A"), http.StatusRequestEntityTooLarge},
+		{"/", &chunkedReader{strings.NewReader("0123456789")}, http.StatusOK},
+		{"/", &chunkedReader{strings.NewReader("0123456789A")}, http.StatusRequestEntityTooLarge},
+		{"/small", strings.NewReader("01234"), http.StatusOK},
+		{"/small", strings.NewReader("012345"), http.StatusRequestEntityTooLarge},
+		{"/small", &chunkedReader{strings.NewReader("012345")}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		accessLogBuffer.Reset()
+		req := httptest.NewRequest(http.MethodPost, tc.path, tc.body)
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Code != tc.expectedStatus {
+			t.Errorf("Expected status %d for %s with %T body, got %d", tc.expectedStatus, tc.path, tc.body, rec.Code)
+			continue
+		} else if tc.expectedStatus == http.StatusOK {
+			continue
+		}
+
+		errorResponse := ErrorResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &errorResponse); err != nil {
+			t.Errorf("Failed unmarshalling error response: %+v", err)
+		} else if errorResponse.Code != "REQUEST_BODY_TOO_LARGE" {
+			t.Errorf("Expected error code 'REQUEST_BODY_TOO_LARGE', got '%s'", errorResponse.Code)
+		}
+
+		accessLog := make(map[string]interface{})
+		if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+			t.Errorf("Failed unmarshalling access log: %+v", err)
+		} else if accessLog["http:req:bodyLimitExceeded"] != true {
+			t.Errorf("Expected access log to record the body limit rejection, got: %+v", accessLog)
+		} else if accessLog["level"] != "warn" {
+			t.Errorf("Expected access log level 'warn', got '%v'", accessLog["level"])
+		}
+	}
+}
+
+func TestHTTPConfigMaxRequestBodySize(t *testing.T) {
+	for _, tc := range []struct {
+		maxRequestBodySize int64
+		expectedStatus     int
+	}{
+		{0, http.StatusOK},
+		{10, http.StatusOK},
+		{5, http.StatusRequestEntityTooLarge},
+	} {
+		engine := gin.New()
+		(&HTTPConfig{MaxRequestBodySize: tc.maxRequestBodySize}).Configure(engine)
+		engine.POST("/", func(c *gin.Context) {
+			if body, err := io.ReadAll(c.Request.Body); err == nil {
+				c.String(http.StatusOK, string(body))
+			}
+		})
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", &chunkedReader{strings.NewReader("0123456789")}))
+		if rec.Code != tc.expectedStatus {
+			t.Errorf("Expected status %d with max request body size %d, got %d", tc.expectedStatus, tc.maxRequestBodySize, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package webutil
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/secureworks/errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Supported response encodings, in order of preference when the client assigns them the same quality
+var supportedContentEncodings = []string{"zstd", "gzip", "deflate"}
+
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+var compressorPools = map[string]*sync.Pool{
+	"zstd": {New: func() interface{} {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		return w
+	}},
+	"gzip": {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"deflate": {New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+}
+
+type CompressionConfig struct {
+	Disabled                    bool     `env:"DISABLED" long:"disabled" description:"Disable response compression"`
+	MinSize                     int      `env:"MIN_SIZE" value-name:"BYTES" long:"min-size" description:"Minimum response body size to compress" default:"1024"`
+	ContentTypes                []string `env:"CONTENT_TYPES" value-name:"TYPE" long:"content-types" description:"Content types eligible for compression (types ending with '/' match by prefix)" default:"application/json" default:"application/graphql-response+json" default:"application/javascript" default:"application/xml" default:"image/svg+xml" default:"text/"`
+	DisableRequestDecompression bool     `env:"DISABLE_REQUEST_DECOMPRESSION" long:"disable-request-decompression" description:"Disable decompression of gzip-encoded request bodies"`
+	MaxDecompressedRequestSize  int64    `env:"MAX_DECOMPRESSED_REQUEST_SIZE" value-name:"BYTES" long:"max-decompressed-request-size" description:"Maximum size of decompressed request bodies (zero for no limit)" default:"10485760"`
+}
+
+func (c *CompressionConfig) Validate() error {
+	if c.MinSize < 0 {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid minimum compression size %d", c.MinSize))
+	} else if c.MaxDecompressedRequestSize < 0 {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid max decompressed request size %d", c.MaxDecompressedRequestSize))
+	}
+	return nil
+}
+
+func (c *CompressionConfig) Configure(router *gin.Engine) {
+	if !c.Disabled {
+		router.Use(CreateGinCompressionMiddleware(*c))
+	}
+}
+
+func (c *CompressionConfig) isContentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.ContentTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if strings.HasSuffix(allowed, "/") {
+			if strings.HasPrefix(mediaType, allowed) {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func negotiateContentEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	wildcardQuality := -1.0
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, found := strings.Cut(param, "="); found && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					quality = q
+				} else {
+					quality = 0
+				}
+			}
+		}
+		if name == "*" {
+			wildcardQuality = quality
+		} else if name == "x-gzip" {
+			qualities["gzip"] = quality
+		} else if name != "" {
+			qualities[name] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range supportedContentEncodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = wildcardQuality
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+type gzipRequestBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipRequestBody) Close() error {
+	if err := b.Reader.Close(); err != nil {
+		_ = b.body.Close()
+		return err
+	}
+	return b.body.Close()
+}
+
+// decompressRequestBody replaces gzip-encoded request bodies with their decompressed content, limited to the given
+// number of bytes (zero or less means no limit). Returns the limiting reader of decompressed bodies, or nil if the
+// body was not decompressed.
+func decompressRequestBody(r *http.Request, limit int64) (*maxBytesReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errors.Chain(err, "failed reading gzip-encoded request body")
+		}
+		body := &maxBytesReadCloser{body: &gzipRequestBody{Reader: reader, body: r.Body}, limit: limit}
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		return body, nil
+	default:
+		return nil, nil
+	}
+}
+
+type compressionResponseWriter struct {
+	gin.ResponseWriter
+	config           *CompressionConfig
+	encoding         string
+	status           int
+	buffer           []byte
+	decided          bool
+	compressor       compressor
+	uncompressedSize int
+}
+
+func (w *compressionResponseWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+	} else if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *compressionResponseWriter) WriteHeaderNow() {
+	if !w.decided {
+		_ = w.decide()
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressionResponseWriter) Write(data []byte) (int, error) {
+	w.uncompressedSize += len(data)
+	if !w.decided {
+		w.buffer = append(w.buffer, data...)
+		if len(w.buffer) < w.config.MinSize {
+			return len(data), nil
+		} else if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	} else if w.compressor != nil {
+		return w.compressor.Write(data)
+	} else {
+		return w.ResponseWriter.Write(data)
+	}
+}
+
+func (w *compressionResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressionResponseWriter) Flush() {
+	if !w.decided {
+		_ = w.decide()
+	}
+	if w.compressor != nil {
+		_ = w.compressor.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressionResponseWriter) Status() int {
+	if w.decided {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *compressionResponseWriter) Size() int {
+	if w.uncompressedSize > 0 {
+		return w.uncompressedSize
+	}
+	return w.ResponseWriter.Size()
+}
+
+func (w *compressionResponseWriter) Written() bool {
+	return w.decided && w.ResponseWriter.Written()
+}
+
+// decide commits the response headers, choosing whether to compress the body based on what was buffered so far
+func (w *compressionResponseWriter) decide() error {
+	w.decided = true
+
+	header := w.Header()
+	if len(w.buffer) > 0 && header.Get("Content-Type") == "" {
+		// Sniff the content type now, since net/http would otherwise sniff the compressed bytes
+		header.Set("Content-Type", http.DetectContentType(w.buffer))
+	}
+
+	if len(w.buffer) > 0 &&
+		len(w.buffer) >= w.config.MinSize &&
+		w.status >= http.StatusOK &&
+		w.status != http.StatusNoContent &&
+		w.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" &&
+		w.config.isContentTypeAllowed(header.Get("Content-Type")) {
+
+		header.Add("Vary", "Accept-Encoding")
+		if w.encoding != "" {
+			w.compressor = compressorPools[w.encoding].Get().(compressor)
+			w.compressor.Reset(w.ResponseWriter)
+			header.Set("Content-Encoding", w.encoding)
+			header.Del("Content-Length")
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	} else if w.compressor != nil {
+		_, err := w.compressor.Write(buffer)
+		return err
+	} else {
+		_, err := w.ResponseWriter.Write(buffer)
+		return err
+	}
+}
+
+func (w *compressionResponseWriter) finish() (compressed bool, err error) {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return false, err
+		}
+	}
+	if w.compressor == nil {
+		return false, nil
+	}
+	err = w.compressor.Close()
+	compressorPools[w.encoding].Put(w.compressor)
+	w.compressor = nil
+	return true, err
+}
+
+// CreateGinCompressionMiddleware compresses responses & decompresses gzip-encoded request bodies as configured.
+// Decompressed bodies are limited to MaxDecompressedRequestSize bytes, failing requests exceeding it with 413. The
+// limit of CreateGinMaxBodySizeMiddleware applies to the compressed body if installed before this middleware, and to
+// the decompressed body if installed after it.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinCompressionMiddleware(config CompressionConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var decompressedBody *maxBytesReadCloser
+		if !config.DisableRequestDecompression {
+			var err error
+			if decompressedBody, err = decompressRequestBody(c.Request, config.MaxDecompressedRequestSize); err != nil {
+				AbortWithErrorResponse(c, http.StatusBadRequest, "INVALID_CONTENT_ENCODING", "Request body could not be decompressed.")
+				return
+			}
+		}
+		checkDecompressedBody := func() {
+			if decompressedBody != nil && decompressedBody.exceeded {
+				abortWithRequestBodyTooLarge(c, decompressedBody.limit)
+			}
+		}
+
+		// Responses to HEAD requests have no body, and upgraded connections are not ours to encode
+		if c.Request.Method == http.MethodHead || c.IsWebsocket() {
+			c.Next()
+			checkDecompressedBody()
+			return
+		}
+
+		w := &compressionResponseWriter{
+			ResponseWriter: c.Writer,
+			config:         &config,
+			encoding:       negotiateContentEncoding(c.GetHeader("Accept-Encoding")),
+			status:         c.Writer.Status(),
+		}
+		c.Writer = w
+		c.Next()
+		checkDecompressedBody()
+		c.Writer = w.ResponseWriter
+
+		if compressed, err := w.finish(); err != nil {
+			_ = c.Error(errors.Chain(err, "failed compressing response"))
+		} else if compressed {
+			SetAccessLogField(c, "http:res:uncompressedSize", w.uncompressedSize)
+		}
+	}
+}
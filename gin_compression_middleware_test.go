@@ -0,0 +1,210 @@
+package webutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	cases := []struct {
+		acceptEncoding   string
+		expectedEncoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, zstd", "zstd"},
+		{"gzip;q=1.0, zstd;q=0.5", "gzip"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"*", "zstd"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, *", "gzip"},
+		{"br", ""},
+		{"GZIP ; Q=0.8, deflate;q=0.9", "deflate"},
+		{"gzip;q=invalid", ""},
+	}
+	for _, c := range cases {
+		if actual := negotiateContentEncoding(c.acceptEncoding); actual != c.expectedEncoding {
+			t.Errorf("expected negotiateContentEncoding(%q) to return %q, got %q", c.acceptEncoding, c.expectedEncoding, actual)
+		}
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	largeBody := strings.Repeat(`{"key":"value"}`, 200)
+	config := CompressionConfig{MinSize: 1024, ContentTypes: []string{"application/json", "text/"}}
+
+	engine := gin.New()
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(GinAccessLogMiddleware)
+	engine.Use(CreateGinCompressionMiddleware(config))
+	engine.GET("/large", func(c *gin.Context) { c.Data(http.StatusOK, "application/json", []byte(largeBody)) })
+	engine.GET("/small", func(c *gin.Context) { c.Data(http.StatusOK, "application/json", []byte(`{}`)) })
+	engine.GET("/binary", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", []byte(largeBody)) })
+	engine.POST("/echo", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Data(http.StatusOK, "text/plain", body)
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		accessLogBuffer.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/large", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Expected gzip content encoding, got '%s'", rec.Header().Get("Content-Encoding"))
+		} else if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Expected 'Vary: Accept-Encoding' header, got '%s'", rec.Header().Get("Vary"))
+		}
+		reader, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("Failed creating gzip reader: %+v", err)
+		}
+		if body, err := io.ReadAll(reader); err != nil {
+			t.Fatalf("Failed decompressing response: %+v", err)
+		} else if string(body) != largeBody {
+			t.Errorf("Expected decompressed body to equal original body")
+		}
+
+		accessLog := make(map[string]interface{})
+		if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+			t.Fatalf("Failed unmarshalling access log: %+v", err)
+		} else if accessLog["http:res:uncompressedSize"] != float64(len(largeBody)) {
+			t.Errorf("Expected uncompressed size %d, got %v", len(largeBody), accessLog["http:res:uncompressedSize"])
+		} else if size := accessLog["http:res:size"].(float64); size <= 0 || size >= float64(len(largeBody)) {
+			t.Errorf("Expected compressed size to be smaller than %d, got %v", len(largeBody), size)
+		}
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/large", nil)
+		req.Header.Set("Accept-Encoding", "gzip;q=0.5, zstd")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != "zstd" {
+			t.Fatalf("Expected zstd content encoding, got '%s'", rec.Header().Get("Content-Encoding"))
+		}
+		decoder, err := zstd.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("Failed creating zstd reader: %+v", err)
+		}
+		defer decoder.Close()
+		if body, err := io.ReadAll(decoder); err != nil {
+			t.Fatalf("Failed decompressing response: %+v", err)
+		} else if string(body) != largeBody {
+			t.Errorf("Expected decompressed body to equal original body")
+		}
+	})
+
+	for _, path := range []string{"/small", "/binary"} {
+		t.Run("uncompressed"+path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, rec.Code)
+			} else if rec.Header().Get("Content-Encoding") != "" {
+				t.Errorf("Expected no content encoding, got '%s'", rec.Header().Get("Content-Encoding"))
+			}
+		})
+	}
+
+	t.Run("request decompression", func(t *testing.T) {
+		compressed := bytes.Buffer{}
+		writer := gzip.NewWriter(&compressed)
+		_, _ = writer.Write([]byte("Hello, World!"))
+		_ = writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/echo", &compressed)
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, rec.Code)
+		} else if rec.Body.String() != "Hello, World!" {
+			t.Errorf("Expected decompressed request body to be echoed, got '%s'", rec.Body.String())
+		}
+	})
+
+	t.Run("invalid request encoding", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("not gzip"))
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestCompressionMiddlewareDecompressedRequestSize(t *testing.T) {
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write(make([]byte, 1<<20))
+	_ = writer.Close()
+
+	testCases := map[string]struct {
+		middlewares    []gin.HandlerFunc
+		expectedStatus int
+	}{
+		"within limit": {
+			middlewares:    []gin.HandlerFunc{CreateGinCompressionMiddleware(CompressionConfig{MaxDecompressedRequestSize: 2 << 20})},
+			expectedStatus: http.StatusOK,
+		},
+		"exceeding limit": {
+			middlewares:    []gin.HandlerFunc{CreateGinCompressionMiddleware(CompressionConfig{MaxDecompressedRequestSize: 1024})},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		"body limit before decompression": {
+			middlewares:    []gin.HandlerFunc{CreateGinMaxBodySizeMiddleware(64 << 10), CreateGinCompressionMiddleware(CompressionConfig{})},
+			expectedStatus: http.StatusOK,
+		},
+		"body limit after decompression": {
+			middlewares:    []gin.HandlerFunc{CreateGinCompressionMiddleware(CompressionConfig{}), CreateGinMaxBodySizeMiddleware(64 << 10)},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			engine := gin.New()
+			engine.Use(tc.middlewares...)
+			engine.POST("/", func(c *gin.Context) {
+				if body, err := io.ReadAll(c.Request.Body); err == nil {
+					c.String(http.StatusOK, "%d", len(body))
+				}
+			})
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed.Bytes()))
+			req.Header.Set("Content-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			} else if tc.expectedStatus == http.StatusRequestEntityTooLarge && !strings.Contains(rec.Body.String(), "REQUEST_BODY_TOO_LARGE") {
+				t.Errorf("Expected REQUEST_BODY_TOO_LARGE error, got: %s", rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package webutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CacheControl struct {
+	Public               bool
+	Private              bool
+	NoCache              bool
+	NoStore              bool
+	NoTransform          bool
+	MustRevalidate       bool
+	ProxyRevalidate      bool
+	Immutable            bool
+	MaxAge               time.Duration
+	SharedMaxAge         time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+//goland:noinspection GoUnusedGlobalVariable
+var (
+	NoStoreCacheControl    = CacheControl{NoStore: true}
+	RevalidateCacheControl = CacheControl{NoCache: true}
+)
+
+func (cc CacheControl) String() string {
+	var directives []string
+	addFlag := func(enabled bool, name string) {
+		if enabled {
+			directives = append(directives, name)
+		}
+	}
+	addDuration := func(d time.Duration, name string) {
+		if d > 0 {
+			directives = append(directives, name+"="+strconv.FormatInt(int64(d/time.Second), 10))
+		}
+	}
+	addFlag(cc.Public, "public")
+	addFlag(cc.Private, "private")
+	addFlag(cc.NoCache, "no-cache")
+	addFlag(cc.NoStore, "no-store")
+	addFlag(cc.NoTransform, "no-transform")
+	addFlag(cc.MustRevalidate, "must-revalidate")
+	addFlag(cc.ProxyRevalidate, "proxy-revalidate")
+	addFlag(cc.Immutable, "immutable")
+	addDuration(cc.MaxAge, "max-age")
+	addDuration(cc.SharedMaxAge, "s-maxage")
+	addDuration(cc.StaleWhileRevalidate, "stale-while-revalidate")
+	addDuration(cc.StaleIfError, "stale-if-error")
+	return strings.Join(directives, ", ")
+}
+
+// CreateGinCacheControlMiddleware sets the given Cache-Control policy on responses; handlers may still override it.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinCacheControlMiddleware(policy CacheControl) gin.HandlerFunc {
+	value := policy.String()
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", value)
+		c.Next()
+	}
+}
+
+func computeETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// etagMatches checks whether the given ETag matches any of the entity tags in the given If-Match or If-None-Match
+// header value, using weak or strong comparison (RFC 7232, section 2.3.2)
+func etagMatches(header, etag string, weakComparison bool) bool {
+	if etag == "" {
+		return false
+	}
+	normalize := func(tag string) (string, bool) {
+		if strings.HasPrefix(tag, "W/") {
+			return tag[2:], true
+		}
+		return tag, false
+	}
+	target, targetWeak := normalize(etag)
+	if targetWeak && !weakComparison {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		value, candidateWeak := normalize(candidate)
+		if value == target && (weakComparison || !candidateWeak) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, header.Get("ETag"), true)
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince == "" {
+		return false
+	} else if since, err := http.ParseTime(ifModifiedSince); err != nil {
+		return false
+	} else if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err != nil {
+		return false
+	} else {
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+}
+
+// CreateGinETagMiddleware buffers successful GET & HEAD responses, sets an ETag header computed from the body (unless
+// the handler provided one) and answers If-None-Match & If-Modified-Since preconditions with 304 Not Modified.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinETagMiddleware(weak bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Next()
+			return
+		}
+
+		w := newBufferedResponseWriter(c.Writer)
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.status == http.StatusOK {
+			header := w.Header()
+			if header.Get("ETag") == "" && w.body.Len() > 0 {
+				header.Set("ETag", computeETag(w.body.Bytes(), weak))
+			}
+			if isNotModified(c.Request, header) {
+				header.Del("Content-Type")
+				header.Del("Content-Length")
+				w.body.Reset()
+				w.status = http.StatusNotModified
+				w.headersOnly = true
+			}
+		}
+
+		if err := w.commit(); err != nil {
+			_ = c.Error(errors.Chain(err, "failed writing buffered response"))
+		}
+	}
+}
+
+// CheckIfMatch evaluates the request's If-Match precondition against the current ETag of the target resource (empty
+// if it does not exist). If the precondition fails, the request is aborted with 412 Precondition Failed and false is
+// returned.
+func CheckIfMatch(c *gin.Context, currentETag string) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" || etagMatches(ifMatch, currentETag, false) {
+		return true
+	}
+	AbortWithErrorResponse(c, http.StatusPreconditionFailed, "PRECONDITION_FAILED", "Resource has been modified.")
+	return false
+}
+
+// CreateGinIfMatchMiddleware enforces If-Match preconditions on unsafe methods, using the given function to obtain the
+// current ETag of the target resource (empty if it does not exist).
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinIfMatchMiddleware(currentETag func(c *gin.Context) (string, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			c.Next()
+			return
+		}
+		if c.GetHeader("If-Match") == "" {
+			c.Next()
+		} else if etag, err := currentETag(c); err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, errors.Chain(err, "failed computing current ETag"))
+		} else if CheckIfMatch(c, etag) {
+			c.Next()
+		}
+	}
+}
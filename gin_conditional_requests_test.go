@@ -0,0 +1,111 @@
+package webutil
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheControlString(t *testing.T) {
+	cases := []struct {
+		policy   CacheControl
+		expected string
+	}{
+		{CacheControl{}, ""},
+		{NoStoreCacheControl, "no-store"},
+		{CacheControl{Public: true, MaxAge: time.Hour}, "public, max-age=3600"},
+		{CacheControl{Private: true, NoCache: true, MustRevalidate: true}, "private, no-cache, must-revalidate"},
+		{CacheControl{Public: true, Immutable: true, SharedMaxAge: time.Minute, StaleWhileRevalidate: 30 * time.Second}, "public, immutable, s-maxage=60, stale-while-revalidate=30"},
+	}
+	for _, c := range cases {
+		if actual := c.policy.String(); actual != c.expected {
+			t.Errorf("Expected %+v to render as %q, got %q", c.policy, c.expected, actual)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	cases := []struct {
+		header         string
+		etag           string
+		weakComparison bool
+		expected       bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"a"`, `"b"`, false, false},
+		{`"b", "a"`, `"a"`, false, true},
+		{`*`, `"a"`, false, true},
+		{`*`, ``, false, false},
+		{`W/"a"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`"a"`, `W/"a"`, false, false},
+	}
+	for _, c := range cases {
+		if actual := etagMatches(c.header, c.etag, c.weakComparison); actual != c.expected {
+			t.Errorf("Expected etagMatches(%q, %q, %v) to return %v", c.header, c.etag, c.weakComparison, c.expected)
+		}
+	}
+}
+
+func TestETagMiddleware(t *testing.T) {
+	lastModified := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	engine := gin.New()
+	engine.Use(CreateGinETagMiddleware(false))
+	engine.GET("/computed", CreateGinCacheControlMiddleware(RevalidateCacheControl), func(c *gin.Context) {
+		c.String(http.StatusOK, "Hello, World!")
+	})
+	engine.GET("/provided", func(c *gin.Context) {
+		c.Header("ETag", `"v1"`)
+		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+		c.String(http.StatusOK, "Hello, World!")
+	})
+	engine.PUT("/provided", CreateGinIfMatchMiddleware(func(*gin.Context) (string, error) { return `"v1"`, nil }), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/computed", nil))
+	computedETag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	} else if computedETag == "" {
+		t.Fatalf("Expected an ETag header to be computed")
+	} else if rec.Body.String() != "Hello, World!" {
+		t.Fatalf("Expected full response body, got '%s'", rec.Body.String())
+	} else if rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("Expected Cache-Control 'no-cache', got '%s'", rec.Header().Get("Cache-Control"))
+	}
+
+	cases := []struct {
+		method         string
+		path           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{http.MethodGet, "/computed", map[string]string{"If-None-Match": computedETag}, http.StatusNotModified},
+		{http.MethodGet, "/computed", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{http.MethodGet, "/provided", map[string]string{"If-None-Match": `W/"v1"`}, http.StatusNotModified},
+		{http.MethodGet, "/provided", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{http.MethodGet, "/provided", map[string]string{"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		{http.MethodPut, "/provided", map[string]string{"If-Match": `"v1"`}, http.StatusNoContent},
+		{http.MethodPut, "/provided", map[string]string{"If-Match": `"v0"`}, http.StatusPreconditionFailed},
+		{http.MethodPut, "/provided", map[string]string{}, http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if rec.Code != tc.expectedStatus {
+			t.Errorf("Expected status %d for %s %s with %v, got %d", tc.expectedStatus, tc.method, tc.path, tc.headers, rec.Code)
+		} else if rec.Code == http.StatusNotModified && rec.Body.Len() > 0 {
+			t.Errorf("Expected no body for 304 response, got '%s'", rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package webutil
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AbortWithErrorResponse aborts the request with the given status and a structured JSON error body, and records the
+// error code in the access log.
+func AbortWithErrorResponse(c *gin.Context, status int, code, message string) {
+	SetAccessLogField(c, "http:res:error:code", code)
+	c.AbortWithStatusJSON(status, ErrorResponse{Code: code, Message: message})
+}
@@ -0,0 +1,277 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyKeyMaxLength   = 255
+	idempotencyMaxRequestBody = 10 << 20
+)
+
+// idempotencyPerResponseHeaders are never recorded nor replayed, as they are specific to the response they were sent in
+var idempotencyPerResponseHeaders = []string{"Date", "Set-Cookie"}
+
+type IdempotentResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+type IdempotencyRecord struct {
+	Fingerprint string
+	Response    *IdempotentResponse // nil while the original request is still in flight
+}
+
+type IdempotencyStore interface {
+	// Reserve atomically reserves the given key for a new request with the given fingerprint. If the key is already
+	// reserved or completed, its existing record is returned instead and no reservation is made.
+	Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error)
+
+	// Complete stores the response of the request that reserved the given key, so it can be replayed for repeats.
+	Complete(ctx context.Context, key string, response *IdempotentResponse, ttl time.Duration) error
+
+	// Release removes the reservation of the given key, allowing a subsequent request to reuse it.
+	Release(ctx context.Context, key string) error
+}
+
+type inMemoryIdempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+type InMemoryIdempotencyStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*inMemoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+//goland:noinspection GoUnusedExportedFunction
+func NewInMemoryIdempotencyStore() *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{entries: make(map[string]*inMemoryIdempotencyEntry), lastSweep: time.Now()}
+}
+
+func (s *InMemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func (s *InMemoryIdempotencyStore) Reserve(_ context.Context, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		record := entry.record
+		return &record, nil
+	}
+	s.entries[key] = &inMemoryIdempotencyEntry{
+		record:    IdempotencyRecord{Fingerprint: fingerprint},
+		expiresAt: now.Add(ttl),
+	}
+	return nil, nil
+}
+
+func (s *InMemoryIdempotencyStore) Complete(_ context.Context, key string, response *IdempotentResponse, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, ok := s.entries[key]; !ok {
+		return errors.NewWithStackTrace(fmt.Sprintf("idempotency key '%s' is not reserved", key))
+	} else {
+		entry.record.Response = response
+		entry.expiresAt = time.Now().Add(ttl)
+		return nil
+	}
+}
+
+func (s *InMemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// idempotencyScopedKey scopes the given key to the authenticated subject, or to anonymous requests if the request was
+// not authenticated, so that principals never replay each other's responses.
+func idempotencyScopedKey(c *gin.Context, key string) string {
+	scope := "anonymous"
+	if claims := GetClaims(c.Request.Context()); claims != nil {
+		scope = "sub:" + claims.RegisteredClaims.Subject
+	}
+	hash := sha256.New()
+	hash.Write([]byte(scope))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func idempotencyFingerprint(c *gin.Context, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(c.Request.URL.RequestURI()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotentResponseHeader returns the headers set by the handler chain, i.e. those differing from the given headers
+// set before it ran (such as the request ID & CORS headers), which must not be replayed for other requests.
+func idempotentResponseHeader(before, after http.Header) http.Header {
+	header := make(http.Header)
+	for name, values := range after {
+		if !slicesEqual(before[name], values) {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	for _, name := range idempotencyPerResponseHeaders {
+		header.Del(name)
+	}
+	return header
+}
+
+func slicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func replayIdempotentResponse(c *gin.Context, response *IdempotentResponse) {
+	header := c.Writer.Header()
+	for name, values := range idempotentResponseHeader(nil, response.Header) {
+		header[name] = values
+	}
+	header.Set("Idempotent-Replayed", "true")
+	SetAccessLogField(c, "http:req:idempotency:replayed", true)
+	c.Data(response.Status, header.Get("Content-Type"), response.Body)
+	c.Abort()
+}
+
+// CreateGinIdempotencyMiddleware makes POST & PATCH requests carrying an Idempotency-Key header safe to retry: the
+// first response for each key (scoped to the authenticated subject) is recorded for the given TTL and replayed for
+// repeated requests. Server errors are not recorded, so such requests may be retried with the same key.
+//
+// Keys are scoped by the claims set by the JWT, token introspection & API key middlewares, so this middleware must be
+// installed after them; otherwise all requests are treated as anonymous and share keys.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinIdempotencyMiddleware(store IdempotencyStore, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost && c.Request.Method != http.MethodPatch {
+			c.Next()
+			return
+		}
+
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		} else if len(key) > idempotencyKeyMaxLength {
+			AbortWithErrorResponse(c, http.StatusBadRequest, "INVALID_IDEMPOTENCY_KEY", "Idempotency key is too long.")
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			// Buffer at most one byte more than the limit, so that oversized bodies are detected even without the
+			// max body size middleware
+			b, err := io.ReadAll(io.LimitReader(c.Request.Body, idempotencyMaxRequestBody+1))
+			if err == nil && len(b) > idempotencyMaxRequestBody {
+				err = &http.MaxBytesError{Limit: idempotencyMaxRequestBody}
+			}
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					abortWithRequestBodyTooLarge(c, maxBytesErr.Limit)
+				} else {
+					_ = c.AbortWithError(http.StatusBadRequest, errors.Chain(err, "failed reading request body"))
+				}
+				return
+			}
+			body = b
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		ctx := c.Request.Context()
+		scopedKey := idempotencyScopedKey(c, key)
+		fingerprint := idempotencyFingerprint(c, body)
+		SetAccessLogField(c, "http:req:idempotency:key", key)
+
+		if existing, err := store.Reserve(ctx, scopedKey, fingerprint, ttl); err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, errors.Chain(err, "failed reserving idempotency key"))
+			return
+		} else if existing == nil {
+			// New key; process normally below
+		} else if existing.Fingerprint != fingerprint {
+			AbortWithErrorResponse(c,
+				http.StatusUnprocessableEntity,
+				"IDEMPOTENCY_KEY_REUSED",
+				"Idempotency key was already used for a different request.")
+			return
+		} else if existing.Response == nil {
+			AbortWithErrorResponse(c,
+				http.StatusConflict,
+				"IDEMPOTENCY_KEY_IN_FLIGHT",
+				"A request with this idempotency key is still being processed.")
+			return
+		} else {
+			replayIdempotentResponse(c, existing.Response)
+			return
+		}
+
+		headerBefore := c.Writer.Header().Clone()
+		w := newBufferedResponseWriter(c.Writer)
+		c.Writer = w
+		completed := false
+		defer func() {
+			// Release the key if the handler chain panicked or failed, so that the client can retry
+			c.Writer = w.ResponseWriter
+			if !completed {
+				if err := store.Release(context.Background(), scopedKey); err != nil {
+					_ = c.Error(errors.Chain(err, "failed releasing idempotency key"))
+				}
+			}
+		}()
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.status < http.StatusInternalServerError {
+			response := &IdempotentResponse{Status: w.status, Header: idempotentResponseHeader(headerBefore, w.Header()), Body: bytes.Clone(w.body.Bytes())}
+			if err := store.Complete(context.Background(), scopedKey, response, ttl); err != nil {
+				_ = c.Error(errors.Chain(err, "failed storing idempotent response"))
+			} else {
+				completed = true
+			}
+		}
+
+		if err := w.commit(); err != nil {
+			_ = c.Error(errors.Chain(err, "failed writing buffered response"))
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package webutil
+
+import (
+	"context"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	var invocations int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	engine := gin.New()
+	engine.ContextWithFallback = true
+	engine.Use(func(c *gin.Context) {
+		if subject := c.GetHeader("X-Test-Subject"); subject != "" {
+			claims := &validator.ValidatedClaims{RegisteredClaims: validator.RegisteredClaims{Subject: subject}}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), jwtmiddleware.ContextKey{}, claims))
+		}
+		c.Next()
+	})
+	engine.Use(CreateGinIdempotencyMiddleware(NewInMemoryIdempotencyStore(), time.Hour))
+	engine.POST("/", func(c *gin.Context) {
+		n := atomic.AddInt32(&invocations, 1)
+		c.String(http.StatusCreated, "created "+strconv.Itoa(int(n)))
+	})
+	engine.POST("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.String(http.StatusCreated, "created")
+	})
+
+	do := func(path, key, subject, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		if subject != "" {
+			req.Header.Set("X-Test-Subject", subject)
+		}
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := do("/", "k1", "alice", "payload")
+	if first.Code != http.StatusCreated || first.Body.String() != "created 1" {
+		t.Fatalf("Expected first request to be processed, got %d: %s", first.Code, first.Body.String())
+	}
+
+	replay := do("/", "k1", "alice", "payload")
+	if replay.Code != http.StatusCreated || replay.Body.String() != "created 1" {
+		t.Errorf("Expected repeated request to replay first response, got %d: %s", replay.Code, replay.Body.String())
+	} else if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected replayed response to be marked as such")
+	}
+
+	if otherSubject := do("/", "k1", "bob", "payload"); otherSubject.Body.String() != "created 2" {
+		t.Errorf("Expected same key of another subject to be processed, got %d: %s", otherSubject.Code, otherSubject.Body.String())
+	}
+
+	if mismatch := do("/", "k1", "alice", "other payload"); mismatch.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d for reused key with different payload, got %d", http.StatusUnprocessableEntity, mismatch.Code)
+	}
+
+	if noKey := do("/", "", "alice", "payload"); noKey.Body.String() != "created 3" {
+		t.Errorf("Expected request without key to be processed, got %d: %s", noKey.Code, noKey.Body.String())
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do("/slow", "k2", "alice", "payload") }()
+	<-started
+	if inFlight := do("/slow", "k2", "alice", "payload"); inFlight.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for concurrent duplicate, got %d", http.StatusConflict, inFlight.Code)
+	}
+	close(release)
+	if slow := <-done; slow.Code != http.StatusCreated {
+		t.Errorf("Expected in-flight request to complete with %d, got %d", http.StatusCreated, slow.Code)
+	}
+}
+
+func TestIdempotencyMiddlewareReplayedHeaders(t *testing.T) {
+	engine := gin.New()
+	engine.Use(CreateGinRequestIDMiddleware())
+	engine.Use(CreateGinIdempotencyMiddleware(NewInMemoryIdempotencyStore(), time.Hour))
+	engine.POST("/", func(c *gin.Context) {
+		c.Header("Location", "/items/1")
+		c.Header("Date", "Mon, 01 Jan 2024 00:00:00 GMT")
+		c.SetCookie("session", "s3cr3t", 0, "/", "", true, true)
+		c.String(http.StatusCreated, "created")
+	})
+
+	do := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", "k1")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := do("payload")
+	replay := do("payload")
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expected response to be replayed, got %d: %s", replay.Code, replay.Body.String())
+	} else if replay.Header().Get("Location") != "/items/1" {
+		t.Errorf("Expected handler headers to be replayed, got: %+v", replay.Header())
+	} else if replay.Header().Get("Set-Cookie") != "" || replay.Header().Get("Date") != "" {
+		t.Errorf("Expected per-response headers to not be replayed, got: %+v", replay.Header())
+	} else if ids := replay.Header().Values("X-Request-ID"); len(ids) != 1 || ids[0] == first.Header().Get("X-Request-ID") {
+		t.Errorf("Expected replayed response to carry its own request ID, got %v (original was '%s')", ids, first.Header().Get("X-Request-ID"))
+	}
+
+	if tooLarge := do(strings.Repeat("x", idempotencyMaxRequestBody+1)); tooLarge.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for oversized body, got %d", http.StatusRequestEntityTooLarge, tooLarge.Code)
+	}
+}
+
+func TestIdempotencyMiddlewareSubjectScope(t *testing.T) {
+	var invocations int32
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		if subject, ok := c.Request.Header["X-Test-Subject"]; ok {
+			claims := &validator.ValidatedClaims{RegisteredClaims: validator.RegisteredClaims{Subject: subject[0]}}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), jwtmiddleware.ContextKey{}, claims))
+		}
+		c.Next()
+	})
+	engine.Use(CreateGinIdempotencyMiddleware(NewInMemoryIdempotencyStore(), time.Hour))
+	engine.POST("/", func(c *gin.Context) {
+		n := atomic.AddInt32(&invocations, 1)
+		c.String(http.StatusCreated, "created "+strconv.Itoa(int(n)))
+	})
+
+	do := func(subject *string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+		req.Header.Set("Idempotency-Key", "k1")
+		if subject != nil {
+			req.Header["X-Test-Subject"] = []string{*subject}
+		}
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	alice, bob, empty := "alice", "bob", ""
+	for i, tc := range []struct {
+		subject      *string
+		expectedBody string
+	}{
+		{&alice, "created 1"},
+		{&bob, "created 2"},
+		{nil, "created 3"},
+		{&empty, "created 4"},
+		{&alice, "created 1"},
+		{&bob, "created 2"},
+		{nil, "created 3"},
+	} {
+		if body := do(tc.subject); body != tc.expectedBody {
+			t.Errorf("Request %d: expected '%s', got '%s'", i, tc.expectedBody, body)
+		}
+	}
+}
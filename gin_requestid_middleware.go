@@ -0,0 +1,196 @@
+package webutil
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRequestIDHeader    = "X-Request-ID"
+	defaultRequestIDMaxLength = 64
+	defaultRequestIDCharset   = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.:"
+	crockfordBase32Alphabet   = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+type requestIDContextKey struct{}
+
+type RequestIDGenerator func() string
+
+//goland:noinspection GoUnusedGlobalVariable
+var (
+	UUIDv4RequestIDGenerator RequestIDGenerator = func() string { return uuid.NewString() }
+	UUIDv7RequestIDGenerator RequestIDGenerator = newUUIDv7
+	ULIDRequestIDGenerator   RequestIDGenerator = newULID
+)
+
+func newUUIDv7() string {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	ms := uint64(time.Now().UnixMilli())
+	b[0], b[1], b[2], b[3], b[4], b[5] = byte(ms>>40), byte(ms>>32), byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms)
+	b[6] = (b[6] & 0x0f) | 0x70 // version 7
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
+
+func newULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+
+	// 128 bits encode into 26 base32 characters, the first of which only carries 3 bits
+	hi, lo := binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16])
+	var s [26]byte
+	for i := 25; i >= 0; i-- {
+		s[i] = crockfordBase32Alphabet[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+type requestIDConfig struct {
+	header         string
+	generator      RequestIDGenerator
+	maxLength      int
+	charset        string
+	ignoreIncoming bool
+}
+
+type RequestIDOption func(*requestIDConfig)
+
+//goland:noinspection GoUnusedExportedFunction
+func WithRequestIDHeader(header string) RequestIDOption {
+	return func(c *requestIDConfig) { c.header = header }
+}
+
+//goland:noinspection GoUnusedExportedFunction
+func WithRequestIDGenerator(generator RequestIDGenerator) RequestIDOption {
+	return func(c *requestIDConfig) { c.generator = generator }
+}
+
+// WithRequestIDMaxLength sets the maximum length of client-supplied request IDs; longer IDs are replaced.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithRequestIDMaxLength(maxLength int) RequestIDOption {
+	return func(c *requestIDConfig) { c.maxLength = maxLength }
+}
+
+// WithRequestIDCharset sets the characters allowed in client-supplied request IDs; IDs with other characters are
+// replaced.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithRequestIDCharset(charset string) RequestIDOption {
+	return func(c *requestIDConfig) { c.charset = charset }
+}
+
+// WithoutIncomingRequestIDs ignores client-supplied request IDs, always generating new ones.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithoutIncomingRequestIDs() RequestIDOption {
+	return func(c *requestIDConfig) { c.ignoreIncoming = true }
+}
+
+func (c *requestIDConfig) isValid(id string) bool {
+	if id == "" || len(id) > c.maxLength {
+		return false
+	}
+	for _, r := range id {
+		if !strings.ContainsRune(c.charset, r) {
+			return false
+		}
+	}
+	return true
+}
+
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinRequestIDMiddleware(options ...RequestIDOption) gin.HandlerFunc {
+	config := &requestIDConfig{
+		header:    defaultRequestIDHeader,
+		generator: UUIDv4RequestIDGenerator,
+		maxLength: defaultRequestIDMaxLength,
+		charset:   defaultRequestIDCharset,
+	}
+	for _, option := range options {
+		option(config)
+	}
+
+	return func(c *gin.Context) {
+		id := c.GetHeader(config.header)
+		if config.ignoreIncoming || !config.isValid(id) {
+			id = config.generator()
+			c.Request.Header.Set(config.header, id)
+		}
+		c.Header(config.header, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDContextKey{}, requestIDValue{header: config.header, id: id}))
+		c.Next()
+	}
+}
+
+type requestIDValue struct {
+	header string
+	id     string
+}
+
+func requestIDValueFromContext(ctx context.Context) (requestIDValue, bool) {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	v, ok := ctx.Value(requestIDContextKey{}).(requestIDValue)
+	return v, ok
+}
+
+// RequestIDFromContext returns the ID of the request being handled in the given context, or an empty string if the
+// request ID middleware was not used.
+func RequestIDFromContext(ctx context.Context) string {
+	if v, ok := requestIDValueFromContext(ctx); ok {
+		return v.id
+	}
+	return ""
+}
+
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if v, ok := requestIDValueFromContext(r.Context()); ok && r.Header.Get(v.header) == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set(v.header, v.id)
+	}
+	return t.next.RoundTrip(r)
+}
+
+// NewRequestIDTransport wraps the given transport (or http.DefaultTransport if nil) so that outgoing requests made
+// with the context of an incoming request carry its request ID.
+func NewRequestIDTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &requestIDTransport{next: next}
+}
+
+// HTTPClient is used for all outgoing HTTP requests made by this package, and propagates request IDs.
+var HTTPClient = &http.Client{Transport: NewRequestIDTransport(nil)}
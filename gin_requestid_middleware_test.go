@@ -0,0 +1,89 @@
+package webutil
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRequestIDGenerators(t *testing.T) {
+	cases := map[string]struct {
+		generator RequestIDGenerator
+		pattern   string
+	}{
+		"uuidv4": {UUIDv4RequestIDGenerator, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		"uuidv7": {UUIDv7RequestIDGenerator, `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		"ulid":   {ULIDRequestIDGenerator, `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`},
+	}
+	for name, c := range cases {
+		first, second := c.generator(), c.generator()
+		if matched, _ := regexp.MatchString(c.pattern, first); !matched {
+			t.Errorf("Expected %s ID '%s' to match '%s'", name, first, c.pattern)
+		} else if first == second {
+			t.Errorf("Expected %s IDs to be unique, got '%s' twice", name, first)
+		}
+	}
+
+	// Time-ordered IDs generated in different milliseconds must sort lexicographically
+	if a, b := newULID(), newULID(); a[:10] > b[:10] {
+		t.Errorf("Expected ULID timestamps to be ordered, got '%s' after '%s'", b, a)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	engine := gin.New()
+	engine.Use(CreateGinRequestIDMiddleware(WithRequestIDGenerator(func() string { return "generated" }), WithRequestIDMaxLength(10)))
+
+	var outgoingRequestID string
+	outgoing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outgoingRequestID = r.Header.Get("X-Request-ID")
+	}))
+	defer outgoing.Close()
+
+	var requestID string
+	engine.GET("/", func(c *gin.Context) {
+		requestID = RequestIDFromContext(c.Request.Context())
+		req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, outgoing.URL, nil)
+		if err != nil {
+			t.Fatalf("Failed creating outgoing request: %+v", err)
+		} else if resp, err := HTTPClient.Do(req); err != nil {
+			t.Fatalf("Failed executing outgoing request: %+v", err)
+		} else {
+			_ = resp.Body.Close()
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		incoming string
+		expected string
+	}{
+		{"", "generated"},
+		{"abc-123", "abc-123"},
+		{"abcdefghijk", "generated"},
+		{"abc 123", "generated"},
+		{"<script>", "generated"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.incoming != "" {
+			req.Header.Set("X-Request-ID", tc.incoming)
+		}
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		if requestID != tc.expected {
+			t.Errorf("Expected request ID for incoming %q to be %q, got %q", tc.incoming, tc.expected, requestID)
+		} else if actual := rec.Header().Get("X-Request-ID"); actual != tc.expected {
+			t.Errorf("Expected response request ID header for incoming %q to be %q, got %q", tc.incoming, tc.expected, actual)
+		} else if outgoingRequestID != tc.expected {
+			t.Errorf("Expected outgoing request ID header for incoming %q to be %q, got %q", tc.incoming, tc.expected, outgoingRequestID)
+		}
+	}
+
+	if id := RequestIDFromContext(context.Background()); id != "" {
+		t.Errorf("Expected no request ID in empty context, got %q", id)
+	}
+}
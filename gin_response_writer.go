@@ -0,0 +1,117 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+)
+
+// bufferedResponseWriter holds back the response status & body until commit is called, so middlewares can inspect or
+// replace the response after the handler chain completes. Headers are still written to the underlying writer's
+// header map directly.
+type bufferedResponseWriter struct {
+	gin.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	headersOnly bool
+}
+
+func newBufferedResponseWriter(w gin.ResponseWriter) *bufferedResponseWriter {
+	return &bufferedResponseWriter{ResponseWriter: w, status: w.Status()}
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedResponseWriter) WriteHeaderNow() {
+	w.headersOnly = true
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedResponseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *bufferedResponseWriter) Size() int {
+	if w.body.Len() == 0 && !w.headersOnly {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *bufferedResponseWriter) Written() bool {
+	return w.headersOnly || w.body.Len() > 0
+}
+
+func (w *bufferedResponseWriter) Flush() {
+	// Intentionally a no-op: flushing would defeat buffering
+}
+
+// commit writes the buffered status & body to the underlying writer
+func (w *bufferedResponseWriter) commit() error {
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.body.Len() == 0 {
+		if w.headersOnly {
+			w.ResponseWriter.WriteHeaderNow()
+		}
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.body.Bytes())
+	return err
+}
+
+// errorRecordingResponseWriter records the first error returned by the underlying writer, which handlers commonly
+// ignore, so middlewares can tell whether the response actually reached the client. It also records whether the
+// request context was already done when the response was committed.
+type errorRecordingResponseWriter struct {
+	gin.ResponseWriter
+	ctx                context.Context
+	err                error
+	committed          bool
+	ctxDoneAtCommitted bool
+}
+
+func (w *errorRecordingResponseWriter) commit() {
+	if !w.committed {
+		w.committed = true
+		w.ctxDoneAtCommitted = w.ctx != nil && w.ctx.Err() != nil
+	}
+}
+
+func (w *errorRecordingResponseWriter) WriteHeaderNow() {
+	w.commit()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *errorRecordingResponseWriter) Write(data []byte) (int, error) {
+	w.commit()
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *errorRecordingResponseWriter) WriteString(s string) (int, error) {
+	w.commit()
+	n, err := w.ResponseWriter.WriteString(s)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *errorRecordingResponseWriter) Flush() {
+	w.commit()
+	w.ResponseWriter.Flush()
+}
@@ -0,0 +1,49 @@
+package webutil
+
+import (
+	"context"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"testing"
+)
+
+func TestGraphAuthDirective(t *testing.T) {
+	scope := "read:items"
+	next := func(ctx context.Context) (interface{}, error) { return "resolved", nil }
+	withScope := func(scopes string) context.Context {
+		claims := &validator.ValidatedClaims{CustomClaims: &OIDCClaims{Scope: scopes}}
+		return context.WithValue(context.Background(), jwtmiddleware.ContextKey{}, claims)
+	}
+
+	testCases := map[string]struct {
+		ctx          context.Context
+		scope        *string
+		expectedCode string
+	}{
+		"anonymous":             {ctx: context.Background(), expectedCode: "UNAUTHENTICATED"},
+		"anonymous with scope":  {ctx: context.Background(), scope: &scope, expectedCode: "UNAUTHENTICATED"},
+		"authenticated":         {ctx: withScope("")},
+		"missing scope":         {ctx: withScope("write:items"), scope: &scope, expectedCode: "FORBIDDEN"},
+		"authenticated & scope": {ctx: withScope("read:items write:items"), scope: &scope},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			result, err := GraphAuthDirective(tc.ctx, nil, next, tc.scope)
+			if tc.expectedCode == "" {
+				if err != nil || result != "resolved" {
+					t.Errorf("Expected field to resolve, got %v (%+v)", result, err)
+				}
+				return
+			} else if err == nil {
+				t.Fatalf("Expected field to fail with %s", tc.expectedCode)
+			}
+
+			// Errors must be presented to clients as-is rather than as internal errors
+			presented := GraphErrorPresenter(tc.ctx, err)
+			if presented.Extensions["code"] != tc.expectedCode {
+				t.Errorf("Expected presented error code %s, got: %+v", tc.expectedCode, presented)
+			}
+		})
+	}
+}
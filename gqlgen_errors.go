@@ -28,8 +28,16 @@ func (e *GraphUserError) Unwrap() error {
 }
 
 func GraphErrorPresenter(ctx context.Context, e error) *gqlerror.Error {
+	requestID := RequestIDFromContext(ctx)
 	if errors.Is(e, &GraphUserError{}) {
-		return e.(*gqlerror.Error)
+		gqlErr := e.(*gqlerror.Error)
+		if requestID != "" {
+			if gqlErr.Extensions == nil {
+				gqlErr.Extensions = make(map[string]interface{})
+			}
+			gqlErr.Extensions["requestId"] = requestID
+		}
+		return gqlErr
 	}
 
 	var ginCtx *gin.Context
@@ -55,10 +63,14 @@ func GraphErrorPresenter(ctx context.Context, e error) *gqlerror.Error {
 			Msg("Internal error occurred")
 	}
 
+	extensions := map[string]interface{}{"code": "INTERNAL_SERVER_ERROR"}
+	if requestID != "" {
+		extensions["requestId"] = requestID
+	}
 	return &gqlerror.Error{
 		Message:    "An internal error has occurred.",
 		Path:       path,
-		Extensions: map[string]interface{}{"code": "INTERNAL_SERVER_ERROR"},
+		Extensions: extensions,
 	}
 }
 
@@ -0,0 +1,335 @@
+package webutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	introspectionCacheMaxEntries  = 10000
+	introspectionResponseMaxBytes = 1 << 20
+	introspectionTimeout          = 10 * time.Second
+)
+
+// WithIntrospectionCacheTTL sets how long active tokens are cached by the token introspection middleware (5 minutes
+// by default). Tokens are never cached beyond their expiry.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithIntrospectionCacheTTL(ttl time.Duration) JWTOption {
+	return func(s *jwtSettings) { s.introspectionCacheTTL = ttl }
+}
+
+// WithIntrospectionNegativeCacheTTL sets how long inactive & invalid tokens are cached by the token introspection
+// middleware (10 seconds by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithIntrospectionNegativeCacheTTL(ttl time.Duration) JWTOption {
+	return func(s *jwtSettings) { s.introspectionNegativeCacheTTL = ttl }
+}
+
+// WithIntrospectionHTTPClient sets the HTTP client used to call the token introspection endpoint.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithIntrospectionHTTPClient(client *http.Client) JWTOption {
+	return func(s *jwtSettings) { s.introspectionHTTPClient = client }
+}
+
+// WithIntrospectionIssuer makes the token introspection middleware reject tokens whose introspection response does not
+// name the given issuer in its "iss" claim. Issuers are not checked by default.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithIntrospectionIssuer(issuer string) JWTOption {
+	return func(s *jwtSettings) { s.introspectionIssuer = issuer }
+}
+
+// CreateTokenIntrospectionGinMiddleware creates a middleware validating opaque access tokens using the given RFC 7662
+// token introspection endpoint, authenticating to it with the given client credentials. It accepts the same options as
+// the JWT middleware (e.g. token extractors & optional authentication) and exposes introspection responses the same
+// way, so GetClaims, GetCustomClaims & HasClaimsScope work regardless of the token type. Custom claims are populated
+// from the introspection response. If audiences are given, tokens must be intended for at least one of them; see
+// WithIntrospectionIssuer for checking their issuer.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateTokenIntrospectionGinMiddleware(
+	introspectionURL, clientID, clientSecret string,
+	audiences []string,
+	customClaimsFunc func() validator.CustomClaims,
+	options ...JWTOption) func(c *gin.Context) {
+	settings := newJWTSettings(options...)
+	if _, err := url.Parse(introspectionURL); err != nil {
+		panic(fmt.Errorf("failed to parse introspection URL: %w", err))
+	}
+	introspector := newTokenIntrospector(introspectionURL, clientID, clientSecret, audiences, customClaimsFunc, settings)
+	return newBearerTokenGinMiddleware(settings, introspector.ValidateToken)
+}
+
+type introspectionResponse struct {
+	Active    bool             `json:"active"`
+	Issuer    string           `json:"iss"`
+	Subject   string           `json:"sub"`
+	Audience  jwt.Audience     `json:"aud"`
+	ID        string           `json:"jti"`
+	Expiry    *jwt.NumericDate `json:"exp"`
+	NotBefore *jwt.NumericDate `json:"nbf"`
+	IssuedAt  *jwt.NumericDate `json:"iat"`
+}
+
+type introspectionCacheEntry struct {
+	claims    *validator.ValidatedClaims
+	err       error
+	expiresAt time.Time
+}
+
+// introspectionCall is an introspection in progress, whose result is shared by all concurrent lookups of its token.
+type introspectionCall struct {
+	done  chan struct{}
+	entry introspectionCacheEntry
+}
+
+// tokenIntrospector validates tokens via a token introspection endpoint, caching results by token hash so that tokens
+// themselves are not retained in memory. Concurrent lookups of a token that is not cached share a single introspection.
+type tokenIntrospector struct {
+	url              string
+	clientID         string
+	clientSecret     string
+	audiences        []string
+	customClaimsFunc func() validator.CustomClaims
+	settings         *jwtSettings
+	now              func() time.Time
+
+	mutex    sync.Mutex
+	cache    map[[sha256.Size]byte]introspectionCacheEntry
+	inflight map[[sha256.Size]byte]*introspectionCall
+}
+
+func newTokenIntrospector(
+	introspectionURL, clientID, clientSecret string,
+	audiences []string,
+	customClaimsFunc func() validator.CustomClaims,
+	settings *jwtSettings) *tokenIntrospector {
+	return &tokenIntrospector{
+		url:              introspectionURL,
+		clientID:         clientID,
+		clientSecret:     clientSecret,
+		audiences:        audiences,
+		customClaimsFunc: customClaimsFunc,
+		settings:         settings,
+		now:              time.Now,
+		cache:            make(map[[sha256.Size]byte]introspectionCacheEntry),
+		inflight:         make(map[[sha256.Size]byte]*introspectionCall),
+	}
+}
+
+// ValidateToken returns the validated claims of the given token, from cache if possible.
+func (ti *tokenIntrospector) ValidateToken(ctx context.Context, token string) (interface{}, error) {
+	entry := ti.lookup(ctx, sha256.Sum256([]byte(token)), token, ti.now())
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return entry.claims, nil
+}
+
+// lookup returns the cache entry of the given token, introspecting it if it is not cached (or expired). Lookups made
+// while the token is being introspected wait for that introspection instead of starting their own.
+func (ti *tokenIntrospector) lookup(ctx context.Context, key [sha256.Size]byte, token string, now time.Time) introspectionCacheEntry {
+	ti.mutex.Lock()
+	if entry, ok := ti.cache[key]; ok && now.Before(entry.expiresAt) {
+		ti.mutex.Unlock()
+		return entry
+	}
+	call, ok := ti.inflight[key]
+	if !ok {
+		call = &introspectionCall{done: make(chan struct{})}
+		ti.inflight[key] = call
+		go ti.introspectShared(log.Ctx(ctx).With().Logger(), key, token, now, call)
+	}
+	ti.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.entry
+	case <-ctx.Done():
+		return introspectionCacheEntry{err: &JWTError{
+			Reason: JWTIntrospectionUnavailable,
+			Err:    errors.Chain(ctx.Err(), "gave up waiting for token introspection"),
+		}}
+	}
+}
+
+// introspectShared performs the given shared introspection using a detached context, so that cancelled requests don't
+// fail the introspection for everyone else waiting for it, and caches its result.
+func (ti *tokenIntrospector) introspectShared(logger zerolog.Logger, key [sha256.Size]byte, token string, now time.Time, call *introspectionCall) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.entry = introspectionCacheEntry{err: &JWTError{
+				Reason: JWTIntrospectionUnavailable,
+				Err:    errors.NewWithStackTrace(fmt.Sprintf("token introspection panicked: %v", r)),
+			}}
+		}
+		ti.mutex.Lock()
+		delete(ti.inflight, key)
+		ti.mutex.Unlock()
+		close(call.done)
+	}()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), introspectionTimeout)
+	defer cancel()
+
+	call.entry = ti.introspect(ctx, token, now)
+	var jwtErr *JWTError
+	if errors.As(call.entry.err, &jwtErr) && jwtErr.Reason == JWTIntrospectionUnavailable {
+		logger.Warn().Err(call.entry.err).Str("url", ti.url).Msg("Token introspection failed")
+	} else {
+		ti.store(key, call.entry, now)
+	}
+}
+
+func (ti *tokenIntrospector) store(key [sha256.Size]byte, entry introspectionCacheEntry, now time.Time) {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	if len(ti.cache) >= introspectionCacheMaxEntries {
+		for k, e := range ti.cache {
+			if !now.Before(e.expiresAt) {
+				delete(ti.cache, k)
+			}
+		}
+		// Still full - evict inactive & invalid tokens first, since they are cheap to reject again, and only then
+		// active ones (map iteration order is random)
+		for _, negativeOnly := range []bool{true, false} {
+			for k, e := range ti.cache {
+				if len(ti.cache) < introspectionCacheMaxEntries {
+					break
+				} else if e.err != nil || !negativeOnly {
+					delete(ti.cache, k)
+				}
+			}
+		}
+	}
+	ti.cache[key] = entry
+}
+
+// introspect calls the introspection endpoint and validates its response, returning a cache entry whose expiry is
+// bounded by the token expiry.
+func (ti *tokenIntrospector) introspect(ctx context.Context, token string, now time.Time) introspectionCacheEntry {
+	negative := func(reason JWTErrorReason, err error) introspectionCacheEntry {
+		return introspectionCacheEntry{
+			err:       &JWTError{Reason: reason, Err: err},
+			expiresAt: now.Add(ti.settings.introspectionNegativeCacheTTL),
+		}
+	}
+
+	body, err := ti.call(ctx, token)
+	if err != nil {
+		return introspectionCacheEntry{err: &JWTError{Reason: JWTIntrospectionUnavailable, Err: err}}
+	}
+	var res introspectionResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		return introspectionCacheEntry{err: &JWTError{
+			Reason: JWTIntrospectionUnavailable,
+			Err:    errors.Chain(err, "failed decoding token introspection response"),
+		}}
+	}
+
+	skew := ti.settings.clockSkew
+	switch {
+	case !res.Active:
+		return negative(JWTInactive, errors.New("token is not active"))
+	case ti.settings.introspectionIssuer != "" && res.Issuer != ti.settings.introspectionIssuer:
+		return negative(JWTInvalidIssuer, errors.NewWithStackTrace(fmt.Sprintf("token issuer '%s' is not '%s'", res.Issuer, ti.settings.introspectionIssuer)))
+	case res.Expiry != nil && now.Add(-skew).After(res.Expiry.Time()):
+		return negative(JWTExpired, errors.New("token is expired"))
+	case res.NotBefore != nil && now.Add(skew).Before(res.NotBefore.Time()):
+		return negative(JWTNotYetValid, errors.New("token is not valid yet"))
+	case len(ti.audiences) > 0 && !containsAnyAudience(res.Audience, ti.audiences):
+		return negative(JWTInvalidAudience, errors.NewWithStackTrace(fmt.Sprintf("token audience %v is not one of %v", []string(res.Audience), ti.audiences)))
+	}
+
+	var customClaims validator.CustomClaims
+	if ti.customClaimsFunc != nil {
+		if customClaims = ti.customClaimsFunc(); customClaims != nil {
+			if err := json.Unmarshal(body, customClaims); err != nil {
+				return negative(JWTInvalidClaims, errors.Chain(err, "failed decoding custom claims"))
+			} else if err := customClaims.Validate(ctx); err != nil {
+				jwtErr := customClaimsError(err)
+				return negative(jwtErr.Reason, jwtErr.Err)
+			}
+		}
+	}
+
+	expiresAt := now.Add(ti.settings.introspectionCacheTTL)
+	if res.Expiry != nil && res.Expiry.Time().Before(expiresAt) {
+		expiresAt = res.Expiry.Time()
+	}
+	return introspectionCacheEntry{
+		claims: &validator.ValidatedClaims{
+			RegisteredClaims: validator.RegisteredClaims{
+				Issuer:    res.Issuer,
+				Subject:   res.Subject,
+				Audience:  res.Audience,
+				ID:        res.ID,
+				Expiry:    numericDateUnix(res.Expiry),
+				NotBefore: numericDateUnix(res.NotBefore),
+				IssuedAt:  numericDateUnix(res.IssuedAt),
+			},
+			CustomClaims: customClaims,
+		},
+		expiresAt: expiresAt,
+	}
+}
+
+// call posts the token to the introspection endpoint, authenticating with HTTP basic authentication (RFC 6749,
+// section 2.3.1), and returns the response body.
+func (ti *tokenIntrospector) call(ctx context.Context, token string) ([]byte, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ti.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Chain(err, "failed creating token introspection request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(ti.clientID), url.QueryEscape(ti.clientSecret))
+
+	res, err := ti.settings.introspectionHTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Chain(err, "failed executing token introspection request")
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, introspectionResponseMaxBytes))
+	if err != nil {
+		return nil, errors.Chain(err, "failed reading token introspection response")
+	} else if res.StatusCode != http.StatusOK {
+		return nil, errors.NewWithStackTrace(fmt.Sprintf("token introspection failed with status %d", res.StatusCode))
+	}
+	return body, nil
+}
+
+func containsAnyAudience(audience jwt.Audience, expected []string) bool {
+	for _, aud := range expected {
+		if audience.Contains(aud) {
+			return true
+		}
+	}
+	return false
+}
+
+func numericDateUnix(date *jwt.NumericDate) int64 {
+	if date == nil {
+		return 0
+	}
+	return date.Time().Unix()
+}
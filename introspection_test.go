@@ -0,0 +1,260 @@
+package webutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/arik-kfir/webutil/webutiltest"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIntrospectionAudience = "https://api.example.invalid"
+
+func newTestIntrospectionIssuer(t *testing.T) *webutiltest.Issuer {
+	return webutiltest.NewIssuer(t, webutiltest.WithClient("api", "secret"), webutiltest.WithAudience(testIntrospectionAudience))
+}
+
+func TestTokenIntrospectionGinMiddleware(t *testing.T) {
+	issuer := newTestIntrospectionIssuer(t)
+	engine := gin.New()
+	engine.Use(CreateTokenIntrospectionGinMiddleware(
+		issuer.IntrospectionURL(),
+		"api",
+		"secret",
+		[]string{testIntrospectionAudience},
+		func() validator.CustomClaims { return &OIDCClaims{} },
+		WithIntrospectionHTTPClient(issuer.Client()),
+		WithIntrospectionIssuer(issuer.URL()),
+	))
+	engine.GET("/", func(c *gin.Context) {
+		if !HasClaimsScope(c.Request.Context(), "read") {
+			c.String(http.StatusForbidden, "forbidden")
+		} else {
+			c.String(http.StatusOK, GetClaims(c.Request.Context()).RegisteredClaims.Subject)
+		}
+	})
+
+	revokedToken := issuer.MintOpaqueToken(map[string]interface{}{"sub": "user"})
+	issuer.RevokeToken(revokedToken)
+	testCases := map[string]struct {
+		token          string
+		expectedStatus int
+		expectedBody   string
+		expectedCode   string
+	}{
+		"active token":   {token: issuer.MintOpaqueToken(map[string]interface{}{"sub": "user", "scope": "read write"}), expectedStatus: http.StatusOK, expectedBody: "user"},
+		"missing scope":  {token: issuer.MintOpaqueToken(map[string]interface{}{"sub": "user", "scope": "write"}), expectedStatus: http.StatusForbidden},
+		"unknown token":  {token: "unknown", expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_INACTIVE"},
+		"revoked token":  {token: revokedToken, expectedStatus: http.StatusUnauthorized, expectedCode: "TOKEN_INACTIVE"},
+		"wrong audience": {token: issuer.MintOpaqueToken(map[string]interface{}{"aud": "other"}), expectedStatus: http.StatusUnauthorized, expectedCode: "INVALID_AUDIENCE"},
+		"wrong issuer":   {token: issuer.MintOpaqueToken(map[string]interface{}{"iss": "https://other.example.invalid/"}), expectedStatus: http.StatusUnauthorized, expectedCode: "INVALID_ISSUER"},
+		"missing token":  {expectedStatus: http.StatusUnauthorized, expectedCode: "MISSING_TOKEN"},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			} else if tc.expectedBody != "" && rec.Body.String() != tc.expectedBody {
+				t.Errorf("Expected body '%s', got '%s'", tc.expectedBody, rec.Body.String())
+			} else if tc.expectedCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+tc.expectedCode+`"`) {
+				t.Errorf("Expected error code '%s', got: %s", tc.expectedCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestTokenIntrospectorCache(t *testing.T) {
+	issuer := newTestIntrospectionIssuer(t)
+	settings := newJWTSettings(
+		WithIntrospectionHTTPClient(issuer.Client()),
+		WithIntrospectionCacheTTL(time.Minute),
+		WithIntrospectionNegativeCacheTTL(10*time.Second),
+	)
+	introspector := newTokenIntrospector(issuer.IntrospectionURL(), "api", "secret", nil, nil, settings)
+	now := time.Now()
+	introspector.now = func() time.Time { return now }
+
+	validate := func(token string) error {
+		_, err := introspector.ValidateToken(context.Background(), token)
+		return err
+	}
+	expectIntrospections := func(expected int) {
+		t.Helper()
+		if actual := issuer.Introspections(); actual != expected {
+			t.Fatalf("Expected %d introspections, got %d", expected, actual)
+		}
+	}
+
+	// Active tokens are cached for the cache TTL...
+	token := issuer.MintOpaqueToken(map[string]interface{}{"sub": "user"})
+	for i := 0; i < 3; i++ {
+		if err := validate(token); err != nil {
+			t.Fatalf("Expected token to be valid: %+v", err)
+		}
+	}
+	expectIntrospections(1)
+	issuer.RevokeToken(token)
+	now = now.Add(time.Minute)
+	if err := validate(token); err == nil {
+		t.Fatalf("Expected revoked token to be rejected after cache TTL")
+	}
+	expectIntrospections(2)
+
+	// ...but never beyond their expiry
+	shortLivedToken := issuer.MintOpaqueToken(map[string]interface{}{"exp": now.Add(5 * time.Second).Unix()})
+	if err := validate(shortLivedToken); err != nil {
+		t.Fatalf("Expected token to be valid: %+v", err)
+	}
+	issuer.RevokeToken(shortLivedToken)
+	now = now.Add(6 * time.Second)
+	var jwtErr *JWTError
+	if err := validate(shortLivedToken); !errors.As(err, &jwtErr) || jwtErr.Reason != JWTInactive {
+		t.Fatalf("Expected token to be introspected again after expiry, got: %+v", err)
+	}
+	expectIntrospections(4)
+
+	// Inactive tokens are cached for the negative cache TTL
+	if err := validate("unknown"); err == nil {
+		t.Fatalf("Expected unknown token to be rejected")
+	} else if err := validate("unknown"); err == nil {
+		t.Fatalf("Expected unknown token to be rejected")
+	}
+	expectIntrospections(5)
+	now = now.Add(10 * time.Second)
+	_ = validate("unknown")
+	expectIntrospections(6)
+
+	// Introspection failures are not cached
+	issuer.SetUnavailable(true)
+	if err := validate("other"); !errors.As(err, &jwtErr) || jwtErr.Reason != JWTIntrospectionUnavailable {
+		t.Fatalf("Expected introspection to be unavailable, got: %+v", err)
+	}
+	issuer.SetUnavailable(false)
+	if err := validate("other"); !errors.As(err, &jwtErr) || jwtErr.Reason != JWTInactive {
+		t.Fatalf("Expected unknown token to be inactive, got: %+v", err)
+	}
+}
+
+func TestTokenIntrospectorConcurrentLookups(t *testing.T) {
+	var introspections atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if introspections.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"active":true,"sub":"user"}`))
+	}))
+	t.Cleanup(server.Close)
+	introspector := newTokenIntrospector(server.URL, "api", "secret", nil, nil, newJWTSettings(WithIntrospectionHTTPClient(server.Client())))
+
+	const lookups = 10
+	errs := make(chan error, lookups)
+	for i := 0; i < lookups; i++ {
+		go func() {
+			_, err := introspector.ValidateToken(context.Background(), "token")
+			errs <- err
+		}()
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond) // let the other lookups join the introspection in progress
+	close(release)
+	for i := 0; i < lookups; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected token to be valid: %+v", err)
+		}
+	}
+	if actual := introspections.Load(); actual != 1 {
+		t.Errorf("Expected 1 introspection, got %d", actual)
+	}
+}
+
+func TestTokenIntrospectorCacheEviction(t *testing.T) {
+	introspector := newTokenIntrospector("https://issuer.example.invalid/introspect", "api", "secret", nil, nil, newJWTSettings())
+	now := time.Now()
+	active := introspectionCacheEntry{claims: &validator.ValidatedClaims{}, expiresAt: now.Add(time.Minute)}
+	inactive := introspectionCacheEntry{err: &JWTError{Reason: JWTInactive}, expiresAt: now.Add(time.Minute)}
+	for i := 0; i < introspectionCacheMaxEntries; i++ {
+		entry := active
+		if i%10 == 0 {
+			entry = inactive
+		}
+		introspector.cache[sha256.Sum256([]byte(fmt.Sprint(i)))] = entry
+	}
+
+	introspector.store(sha256.Sum256([]byte("new")), active, now)
+	var activeEntries int
+	for _, entry := range introspector.cache {
+		if entry.err == nil {
+			activeEntries++
+		}
+	}
+	if len(introspector.cache) != introspectionCacheMaxEntries {
+		t.Errorf("Expected %d cache entries, got %d", introspectionCacheMaxEntries, len(introspector.cache))
+	} else if expected := introspectionCacheMaxEntries*9/10 + 1; activeEntries != expected {
+		t.Errorf("Expected inactive tokens to be evicted first, keeping %d active tokens, got %d", expected, activeEntries)
+	}
+}
+
+func TestTokenIntrospectorCancelledLookup(t *testing.T) {
+	var introspections atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if introspections.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"active":true,"sub":"user"}`))
+	}))
+	t.Cleanup(server.Close)
+	introspector := newTokenIntrospector(server.URL, "api", "secret", nil, nil, newJWTSettings(WithIntrospectionHTTPClient(server.Client())))
+
+	// The first lookup starts the introspection, and is cancelled while the second one waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := introspector.ValidateToken(ctx, "token")
+		first <- err
+	}()
+	<-started
+	second := make(chan error, 1)
+	go func() {
+		_, err := introspector.ValidateToken(context.Background(), "token")
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let the second lookup join the introspection in progress
+	cancel()
+
+	var jwtErr *JWTError
+	if err := <-first; !errors.As(err, &jwtErr) || jwtErr.Reason != JWTIntrospectionUnavailable {
+		t.Errorf("Expected cancelled lookup to fail, got: %+v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("Expected waiting lookup to succeed, got: %+v", err)
+	} else if actual := introspections.Load(); actual != 1 {
+		t.Errorf("Expected 1 introspection, got %d", actual)
+	}
+	if _, err := introspector.ValidateToken(context.Background(), "token"); err != nil {
+		t.Errorf("Expected token to be cached as valid, got: %+v", err)
+	} else if actual := introspections.Load(); actual != 1 {
+		t.Errorf("Expected cached result, got %d introspections", actual)
+	}
+}
@@ -0,0 +1,254 @@
+package webutil
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/auth0/go-jwt-middleware/v2/jwks"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jwksFetchTimeout = 10 * time.Second
+
+var (
+	jwksMetrics      = expvar.NewMap("webutil_jwks")
+	jwksMetricsMutex sync.Mutex
+)
+
+// jwksIssuerMetrics returns the JWKS metrics of the given issuer, published under the "webutil_jwks" expvar.
+func jwksIssuerMetrics(issuer string) *expvar.Map {
+	jwksMetricsMutex.Lock()
+	defer jwksMetricsMutex.Unlock()
+	if metrics, ok := jwksMetrics.Get(issuer).(*expvar.Map); ok {
+		return metrics
+	}
+	metrics := new(expvar.Map).Init()
+	jwksMetrics.Set(issuer, metrics)
+	return metrics
+}
+
+// WithJWKSCacheTTL sets how long fetched JWKS are used before being fetched again (5 minutes by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJWKSCacheTTL(ttl time.Duration) JWTOption {
+	return func(s *jwtSettings) { s.jwksCacheTTL = ttl }
+}
+
+// WithJWKSMaxStaleness sets how long past their TTL cached JWKS keep being used while the issuer is unreachable (1
+// hour by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJWKSMaxStaleness(maxStaleness time.Duration) JWTOption {
+	return func(s *jwtSettings) { s.jwksMaxStaleness = maxStaleness }
+}
+
+// WithJWKSRefetchInterval sets the minimum interval between JWKS fetches triggered by requests, e.g. by tokens signed
+// with an unknown key ID or after a failed fetch (30 seconds by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJWKSRefetchInterval(interval time.Duration) JWTOption {
+	return func(s *jwtSettings) { s.jwksRefetchInterval = interval }
+}
+
+// WithJWKSBackgroundRefresh makes the JWT middleware fetch JWKS immediately and then every given interval (half the
+// cache TTL if zero) until the given context is done, so that requests never wait for JWKS fetches.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJWKSBackgroundRefresh(ctx context.Context, interval time.Duration) JWTOption {
+	return func(s *jwtSettings) {
+		s.jwksRefreshContext = ctx
+		s.jwksRefreshInterval = interval
+	}
+}
+
+// WithJWKSHTTPClient sets the HTTP client used to fetch the OpenID configuration & JWKS of the issuer.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJWKSHTTPClient(client *http.Client) JWTOption {
+	return func(s *jwtSettings) { s.jwksHTTPClient = client }
+}
+
+type jwksKeyIDKey struct{}
+
+// withTokenKeyID returns a context carrying the key ID of the given token, so that the JWKS provider can tell whether
+// its cached key set can verify it. Only the token header is decoded, leaving full parsing to the validator.
+func withTokenKeyID(ctx context.Context, token string) context.Context {
+	encodedHeader, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return ctx
+	}
+	var header struct {
+		KeyID string `json:"kid"`
+	}
+	if decoded, err := base64.RawURLEncoding.DecodeString(encodedHeader); err != nil {
+		return ctx
+	} else if err := json.Unmarshal(decoded, &header); err != nil || header.KeyID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, jwksKeyIDKey{}, header.KeyID)
+}
+
+// jwksProvider caches the JWKS of an issuer, refetching it when it expires or when a token signed by an unknown key
+// arrives (rate-limited to the refetch interval), and serving cached keys while the issuer is unreachable.
+type jwksProvider struct {
+	fetcher         *jwks.Provider
+	issuer          string
+	ttl             time.Duration
+	maxStaleness    time.Duration
+	refetchInterval time.Duration
+	metrics         *expvar.Map
+	now             func() time.Time
+
+	fetchMutex  sync.Mutex
+	mutex       sync.RWMutex
+	keys        *jose.JSONWebKeySet
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	lastErr     error
+}
+
+func newJWKSProvider(issuerURL *url.URL, settings *jwtSettings) *jwksProvider {
+	p := &jwksProvider{
+		fetcher:         jwks.NewProvider(issuerURL, jwks.WithCustomClient(settings.jwksHTTPClient)),
+		issuer:          issuerURL.String(),
+		ttl:             settings.jwksCacheTTL,
+		maxStaleness:    settings.jwksMaxStaleness,
+		refetchInterval: settings.jwksRefetchInterval,
+		metrics:         jwksIssuerMetrics(issuerURL.String()),
+		now:             time.Now,
+	}
+	if settings.jwksRefreshContext != nil {
+		interval := settings.jwksRefreshInterval
+		if interval <= 0 {
+			interval = p.ttl / 2
+		}
+		go p.refreshPeriodically(settings.jwksRefreshContext, interval)
+	}
+	return p
+}
+
+// KeyFunc returns the key set to verify tokens with, as required by the JWT validator.
+func (p *jwksProvider) KeyFunc(ctx context.Context) (interface{}, error) {
+	kid, _ := ctx.Value(jwksKeyIDKey{}).(string)
+	if keys, ok, err := p.lookup(kid); ok {
+		return keys, err
+	}
+	return p.fetch(ctx, kid, false)
+}
+
+func (p *jwksProvider) refreshPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, _ = p.fetch(log.Logger.WithContext(ctx), "", true)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lookup returns the cached key set (or the last fetch error) if it can be used for a token with the given key ID
+// without fetching the key set again.
+func (p *jwksProvider) lookup(kid string) (*jose.JSONWebKeySet, bool, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	now := p.now()
+	expired := p.keys == nil || now.Sub(p.fetchedAt) >= p.ttl
+	unknownKeyID := p.keys != nil && kid != "" && len(p.keys.Key(kid)) == 0
+	if !expired && !unknownKeyID {
+		return p.keys, true, nil
+	} else if now.Sub(p.attemptedAt) < p.refetchInterval {
+		// Fetched recently - don't hammer the issuer
+		keys, err := p.usableKeys(now)
+		return keys, true, err
+	}
+	return nil, false, nil
+}
+
+// usableKeys returns the cached key set unless it is beyond its maximum staleness, in which case the last fetch error
+// is returned. Must be called while holding the mutex.
+func (p *jwksProvider) usableKeys(now time.Time) (*jose.JSONWebKeySet, error) {
+	age := now.Sub(p.fetchedAt)
+	switch {
+	case p.keys == nil:
+		return nil, p.lastErr
+	case age < p.ttl:
+		return p.keys, nil
+	case age < p.ttl+p.maxStaleness:
+		p.metrics.Add("staleServed", 1)
+		return p.keys, nil
+	case p.lastErr != nil:
+		return nil, errors.Chain(p.lastErr, "cached JWKS of '%s' is too stale", p.issuer)
+	default:
+		return nil, errors.NewWithStackTrace(fmt.Sprintf("cached JWKS of '%s' is too stale", p.issuer))
+	}
+}
+
+func (p *jwksProvider) fetch(ctx context.Context, kid string, force bool) (*jose.JSONWebKeySet, error) {
+	p.fetchMutex.Lock()
+	defer p.fetchMutex.Unlock()
+
+	if !force {
+		// Another request may have fetched the key set while we were waiting
+		if keys, ok, err := p.lookup(kid); ok {
+			return keys, err
+		}
+		p.mutex.RLock()
+		if p.keys != nil && p.now().Sub(p.fetchedAt) < p.ttl {
+			p.metrics.Add("unknownKeyIDRefetches", 1)
+		}
+		p.mutex.RUnlock()
+	}
+
+	// Fetch using a detached context so that cancelled requests don't fail the fetch for everyone else
+	logger := log.Ctx(ctx).With().Str("issuer", p.issuer).Logger()
+	fetchCtx, cancel := context.WithTimeout(logger.WithContext(context.Background()), jwksFetchTimeout)
+	defer cancel()
+
+	p.metrics.Add("fetches", 1)
+	var keys *jose.JSONWebKeySet
+	result, err := p.fetcher.KeyFunc(fetchCtx)
+	if err != nil {
+		err = errors.Chain(err, "failed fetching JWKS of '%s'", p.issuer)
+	} else if keys = result.(*jose.JSONWebKeySet); len(keys.Keys) == 0 {
+		err = errors.NewWithStackTrace(fmt.Sprintf("JWKS of '%s' contains no keys", p.issuer))
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.attemptedAt = p.now()
+	if err != nil {
+		p.lastErr = err
+		p.metrics.Add("fetchErrors", 1)
+		keys, usableErr := p.usableKeys(p.attemptedAt)
+		if keys != nil {
+			logger.Warn().Err(err).Time("fetchedAt", p.fetchedAt).Msg("Failed refreshing JWKS, using cached keys")
+		} else {
+			logger.Error().Err(err).Msg("Failed fetching JWKS")
+		}
+		return keys, usableErr
+	}
+
+	p.keys, p.fetchedAt, p.lastErr = keys, p.attemptedAt, nil
+	p.metrics.Set("keys", expvarInt(int64(len(keys.Keys))))
+	logger.Debug().Int("keys", len(keys.Keys)).Msg("Fetched JWKS")
+	return keys, nil
+}
+
+func expvarInt(value int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(value)
+	return v
+}
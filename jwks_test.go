@@ -0,0 +1,113 @@
+package webutil
+
+import (
+	"context"
+	"github.com/arik-kfir/webutil/webutiltest"
+	"gopkg.in/square/go-jose.v2"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestJWKSProvider(t *testing.T, issuer *webutiltest.Issuer, options ...JWTOption) *jwksProvider {
+	issuerURL, err := url.Parse(issuer.URL())
+	if err != nil {
+		t.Fatalf("Failed parsing issuer URL: %+v", err)
+	}
+	return newJWKSProvider(issuerURL, newJWTSettings(append([]JWTOption{WithJWKSHTTPClient(issuer.Client())}, options...)...))
+}
+
+func TestJWKSProvider(t *testing.T) {
+	issuer := webutiltest.NewIssuer(t, webutiltest.WithAlgorithm(webutiltest.ES256))
+	kid := issuer.KeyID()
+	provider := newTestJWKSProvider(t, issuer, WithJWKSCacheTTL(time.Minute), WithJWKSRefetchInterval(10*time.Second), WithJWKSMaxStaleness(time.Hour))
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+
+	keyFunc := func(kid string) (*jose.JSONWebKeySet, error) {
+		ctx := context.WithValue(context.Background(), jwksKeyIDKey{}, kid)
+		keys, err := provider.KeyFunc(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return keys.(*jose.JSONWebKeySet), nil
+	}
+	expectFetches := func(expected int) {
+		t.Helper()
+		if actual := issuer.JWKSFetches(); actual != expected {
+			t.Fatalf("Expected %d JWKS fetches, got %d", expected, actual)
+		}
+	}
+
+	// Keys are fetched once and then cached
+	for i := 0; i < 3; i++ {
+		if keys, err := keyFunc(kid); err != nil {
+			t.Fatalf("Failed getting keys: %+v", err)
+		} else if len(keys.Key(kid)) != 1 {
+			t.Fatalf("Expected key '%s' in key set, got: %+v", kid, keys)
+		}
+	}
+	expectFetches(1)
+
+	// Unknown key IDs trigger a refetch, rate-limited to the refetch interval
+	rotatedKID := issuer.RotateKey()
+	if _, err := keyFunc("unknown"); err != nil {
+		t.Fatalf("Failed getting keys: %+v", err)
+	}
+	expectFetches(1)
+	now = now.Add(10 * time.Second)
+	if keys, err := keyFunc(rotatedKID); err != nil {
+		t.Fatalf("Failed getting keys: %+v", err)
+	} else if len(keys.Key(rotatedKID)) != 1 {
+		t.Fatalf("Expected key '%s' in refetched key set, got: %+v", rotatedKID, keys)
+	}
+	expectFetches(2)
+	if _, err := keyFunc("unknown"); err != nil {
+		t.Fatalf("Failed getting keys: %+v", err)
+	}
+	expectFetches(2)
+
+	// Expired keys are served stale while the issuer is unreachable
+	issuer.SetUnavailable(true)
+	now = now.Add(2 * time.Minute)
+	if keys, err := keyFunc(kid); err != nil {
+		t.Fatalf("Expected stale keys to be served, got: %+v", err)
+	} else if len(keys.Key(rotatedKID)) != 1 {
+		t.Fatalf("Expected stale key set, got: %+v", keys)
+	}
+	if provider.metrics.Get("fetchErrors").String() != "1" {
+		t.Errorf("Expected 1 fetch error, got %s", provider.metrics.Get("fetchErrors"))
+	}
+
+	// ...but not beyond the maximum staleness
+	now = now.Add(2 * time.Hour)
+	if _, err := keyFunc(kid); err == nil {
+		t.Fatalf("Expected keys beyond maximum staleness to be rejected")
+	}
+
+	// Recovery of the issuer is picked up after the refetch interval
+	issuer.SetUnavailable(false)
+	if _, err := keyFunc(kid); err == nil {
+		t.Fatalf("Expected refetch to be rate-limited")
+	}
+	now = now.Add(10 * time.Second)
+	if _, err := keyFunc(kid); err != nil {
+		t.Fatalf("Failed getting keys: %+v", err)
+	}
+	expectFetches(3)
+}
+
+func TestJWKSProviderBackgroundRefresh(t *testing.T) {
+	issuer := webutiltest.NewIssuer(t, webutiltest.WithAlgorithm(webutiltest.ES256))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newTestJWKSProvider(t, issuer, WithJWKSBackgroundRefresh(ctx, 10*time.Millisecond))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for issuer.JWKSFetches() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected JWKS to be refreshed in the background, got %d fetches", issuer.JWKSFetches())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+package webutil
+
+import (
+	"fmt"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"net/http"
+	"strings"
+)
+
+// JWTErrorReason classifies why a request failed JWT authentication.
+type JWTErrorReason string
+
+const (
+	JWTMissing           JWTErrorReason = "missing_token"
+	JWTMalformed         JWTErrorReason = "malformed_token"
+	JWTExpired           JWTErrorReason = "token_expired"
+	JWTNotYetValid       JWTErrorReason = "token_not_yet_valid"
+	JWTInvalidIssuer     JWTErrorReason = "invalid_issuer"
+	JWTInvalidAudience   JWTErrorReason = "invalid_audience"
+	JWTInvalidSignature  JWTErrorReason = "invalid_signature"
+	JWTUnknownKeyID      JWTErrorReason = "unknown_key_id"
+	JWTInvalidClaims     JWTErrorReason = "invalid_claims"
+	JWTInsufficientScope JWTErrorReason = "insufficient_scope"
+	JWTKeysUnavailable   JWTErrorReason = "keys_unavailable"
+
+	// JWTInactive & JWTIntrospectionUnavailable are reported by the token introspection middleware
+	JWTInactive                 JWTErrorReason = "token_inactive"
+	JWTIntrospectionUnavailable JWTErrorReason = "introspection_unavailable"
+)
+
+var jwtErrorDescriptions = map[JWTErrorReason]string{
+	JWTMissing:           "An access token is required",
+	JWTMalformed:         "The access token is malformed",
+	JWTExpired:           "The access token expired",
+	JWTNotYetValid:       "The access token is not valid yet",
+	JWTInvalidIssuer:     "The access token was issued by an unexpected issuer",
+	JWTInvalidAudience:   "The access token is not intended for this audience",
+	JWTInvalidSignature:  "The access token signature is invalid",
+	JWTUnknownKeyID:      "The access token was signed by an unknown key",
+	JWTInvalidClaims:     "The access token claims are invalid",
+	JWTInsufficientScope: "The access token lacks a required scope",
+	JWTKeysUnavailable:   "Access tokens cannot be verified at the moment",
+
+	JWTInactive:                 "The access token is not active",
+	JWTIntrospectionUnavailable: "Access tokens cannot be verified at the moment",
+}
+
+// JWTError is the error recorded in the gin context when JWT authentication fails.
+type JWTError struct {
+	Reason JWTErrorReason
+	Err    error
+}
+
+func (e *JWTError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("failed to validate JWT: %s", e.Reason)
+	}
+	return fmt.Sprintf("failed to validate JWT (%s): %s", e.Reason, e.Err)
+}
+
+func (e *JWTError) Unwrap() error {
+	return e.Err
+}
+
+// Code returns the error code sent in the JSON body of the response, e.g. "TOKEN_EXPIRED".
+func (e *JWTError) Code() string {
+	return strings.ToUpper(string(e.Reason))
+}
+
+// Description returns a human-readable description of the failure, safe to send to clients.
+func (e *JWTError) Description() string {
+	if description, ok := jwtErrorDescriptions[e.Reason]; ok {
+		return description
+	}
+	return "The access token is invalid"
+}
+
+// customClaimsError translates an error returned by custom claims validation into a JWTError.
+func customClaimsError(err error) *JWTError {
+	var scopeErr *InsufficientScopeError
+	if errors.As(err, &scopeErr) {
+		return &JWTError{Reason: JWTInsufficientScope, Err: err}
+	}
+	return &JWTError{Reason: JWTInvalidClaims, Err: errors.Chain(err, "custom claims not validated")}
+}
+
+// classifyJWTError translates errors returned by the JWT middleware & validator into a JWTError.
+func classifyJWTError(err error) *JWTError {
+	var jwtErr *JWTError
+	if errors.As(err, &jwtErr) {
+		return jwtErr
+	}
+
+	reason := JWTMalformed
+	switch {
+	case errors.Is(err, jwtmiddleware.ErrJWTMissing):
+		reason = JWTMissing
+	case errors.Is(err, jwt.ErrExpired):
+		reason = JWTExpired
+	case errors.Is(err, jwt.ErrNotValidYet), errors.Is(err, jwt.ErrIssuedInTheFuture):
+		reason = JWTNotYetValid
+	case errors.Is(err, jwt.ErrInvalidIssuer):
+		reason = JWTInvalidIssuer
+	case errors.Is(err, jwt.ErrInvalidAudience):
+		reason = JWTInvalidAudience
+	case errors.Is(err, jose.ErrCryptoFailure):
+		reason = JWTInvalidSignature
+	case errors.Is(err, jose.ErrUnsupportedKeyType):
+		// go-jose falls back to verifying with the whole key set when no key matches the token's "kid"
+		reason = JWTUnknownKeyID
+	}
+	return &JWTError{Reason: reason, Err: err}
+}
+
+// abortWithJWTError aborts the request with a RFC 6750 compliant response for the given JWT validation error, and
+// records the failure reason in the access log.
+func abortWithJWTError(c *gin.Context, err error) {
+	jwtErr := classifyJWTError(err)
+	_ = c.Error(jwtErr)
+	SetAccessLogField(c, "auth:error", string(jwtErr.Reason))
+
+	switch jwtErr.Reason {
+	case JWTKeysUnavailable, JWTIntrospectionUnavailable:
+		AbortWithErrorResponse(c, http.StatusServiceUnavailable, jwtErr.Code(), jwtErr.Description())
+	case JWTInsufficientScope:
+		// Valid tokens lacking a required scope are forbidden rather than unauthorized (RFC 6750, section 3.1)
+		authenticate := fmt.Sprintf(`Bearer error="insufficient_scope", error_description="%s"`, jwtErr.Description())
+		var scopeErr *InsufficientScopeError
+		if errors.As(jwtErr, &scopeErr) {
+			authenticate += fmt.Sprintf(`, scope="%s"`, scopeErr.Scope)
+		}
+		c.Header("WWW-Authenticate", authenticate)
+		AbortWithErrorResponse(c, http.StatusForbidden, jwtErr.Code(), jwtErr.Description())
+	case JWTMissing:
+		// Requests lacking any authentication information should not receive an error code (RFC 6750, section 3.1)
+		c.Header("WWW-Authenticate", "Bearer")
+		AbortWithErrorResponse(c, http.StatusUnauthorized, jwtErr.Code(), jwtErr.Description())
+	default:
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, jwtErr.Description()))
+		AbortWithErrorResponse(c, http.StatusUnauthorized, jwtErr.Code(), jwtErr.Description())
+	}
+}
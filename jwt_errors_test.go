@@ -0,0 +1,188 @@
+package webutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/secureworks/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassifyJWTError(t *testing.T) {
+	const issuer = "https://issuer.example.invalid/"
+	const audience = "https://api.example.invalid"
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed generating key: %+v", err)
+		}
+		return key
+	}
+	signingKey, otherKey := newKey(), newKey()
+	keySet := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &signingKey.PublicKey, KeyID: "k1", Algorithm: "ES256", Use: "sig"}}}
+
+	var keysErr error
+	validateToken, err := newJWTTokenValidator(
+		func(context.Context) (interface{}, error) { return keySet, keysErr },
+		validator.ES256,
+		issuer,
+		[]string{audience},
+		NewOIDCClaims("read"),
+		time.Minute,
+	)
+	if err != nil {
+		t.Fatalf("Failed creating validator: %+v", err)
+	}
+
+	mint := func(key *ecdsa.PrivateKey, kid string, claims jwt.Claims, scope string) string {
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: key},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid),
+		)
+		if err != nil {
+			t.Fatalf("Failed creating signer: %+v", err)
+		}
+		token, err := jwt.Signed(signer).Claims(claims).Claims(map[string]interface{}{"scope": scope}).CompactSerialize()
+		if err != nil {
+			t.Fatalf("Failed signing token: %+v", err)
+		}
+		return token
+	}
+	now := time.Now()
+	validClaims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   issuer,
+			Subject:  "user",
+			Audience: jwt.Audience{audience},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(now),
+		}
+	}
+	withClaims := func(f func(c *jwt.Claims)) jwt.Claims {
+		claims := validClaims()
+		f(&claims)
+		return claims
+	}
+
+	testCases := map[string]struct {
+		token          string
+		keysErr        error
+		expectedReason JWTErrorReason
+	}{
+		"malformed":        {token: "not-a-jwt", expectedReason: JWTMalformed},
+		"expired":          {token: mint(signingKey, "k1", withClaims(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(now.Add(-time.Hour)) }), "read"), expectedReason: JWTExpired},
+		"not yet valid":    {token: mint(signingKey, "k1", withClaims(func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) }), "read"), expectedReason: JWTNotYetValid},
+		"wrong issuer":     {token: mint(signingKey, "k1", withClaims(func(c *jwt.Claims) { c.Issuer = "https://other.example.invalid/" }), "read"), expectedReason: JWTInvalidIssuer},
+		"wrong audience":   {token: mint(signingKey, "k1", withClaims(func(c *jwt.Claims) { c.Audience = jwt.Audience{"other"} }), "read"), expectedReason: JWTInvalidAudience},
+		"bad signature":    {token: mint(otherKey, "k1", validClaims(), "read"), expectedReason: JWTInvalidSignature},
+		"unknown kid":      {token: mint(otherKey, "k2", validClaims(), "read"), expectedReason: JWTUnknownKeyID},
+		"missing scope":    {token: mint(signingKey, "k1", validClaims(), "write"), expectedReason: JWTInsufficientScope},
+		"keys unavailable": {token: mint(signingKey, "k1", validClaims(), "read"), keysErr: errors.New("connection refused"), expectedReason: JWTKeysUnavailable},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			keysErr = tc.keysErr
+			if _, err := validateToken(context.Background(), tc.token); err == nil {
+				t.Fatalf("Expected token validation to fail")
+			} else if jwtErr := classifyJWTError(err); jwtErr.Reason != tc.expectedReason {
+				t.Errorf("Expected reason '%s', got '%s' for: %+v", tc.expectedReason, jwtErr.Reason, err)
+			}
+		})
+	}
+
+	keysErr = nil
+	if _, err := validateToken(context.Background(), mint(signingKey, "k1", validClaims(), "read")); err != nil {
+		t.Errorf("Expected valid token to pass validation: %+v", err)
+	}
+	if jwtErr := classifyJWTError(jwtmiddleware.ErrJWTMissing); jwtErr.Reason != JWTMissing {
+		t.Errorf("Expected reason '%s', got '%s'", JWTMissing, jwtErr.Reason)
+	}
+}
+
+func TestJWTErrorResponse(t *testing.T) {
+	testCases := map[string]struct {
+		err                     error
+		expectedStatus          int
+		expectedAuthenticate    string
+		expectedCode            string
+		expectedAccessLogReason string
+	}{
+		"missing": {
+			err:                     jwtmiddleware.ErrJWTMissing,
+			expectedStatus:          http.StatusUnauthorized,
+			expectedAuthenticate:    "Bearer",
+			expectedCode:            "MISSING_TOKEN",
+			expectedAccessLogReason: "missing_token",
+		},
+		"expired": {
+			err:                     &JWTError{Reason: JWTExpired},
+			expectedStatus:          http.StatusUnauthorized,
+			expectedAuthenticate:    `Bearer error="invalid_token", error_description="The access token expired"`,
+			expectedCode:            "TOKEN_EXPIRED",
+			expectedAccessLogReason: "token_expired",
+		},
+		"insufficient scope": {
+			err:                     customClaimsError(&InsufficientScopeError{Scope: "write"}),
+			expectedStatus:          http.StatusForbidden,
+			expectedAuthenticate:    `Bearer error="insufficient_scope", error_description="The access token lacks a required scope", scope="write"`,
+			expectedCode:            "INSUFFICIENT_SCOPE",
+			expectedAccessLogReason: "insufficient_scope",
+		},
+		"invalid claims": {
+			err:                     customClaimsError(errors.New("bad claims")),
+			expectedStatus:          http.StatusUnauthorized,
+			expectedAuthenticate:    `Bearer error="invalid_token", error_description="The access token claims are invalid"`,
+			expectedCode:            "INVALID_CLAIMS",
+			expectedAccessLogReason: "invalid_claims",
+		},
+		"keys unavailable": {
+			err:                     &JWTError{Reason: JWTKeysUnavailable},
+			expectedStatus:          http.StatusServiceUnavailable,
+			expectedCode:            "KEYS_UNAVAILABLE",
+			expectedAccessLogReason: "keys_unavailable",
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var accessLogReason interface{}
+			engine := gin.New()
+			engine.Use(func(c *gin.Context) {
+				c.Next()
+				if fields, ok := c.Get(accessLogFieldsKey); ok {
+					accessLogReason = fields.(map[string]interface{})["auth:error"]
+				}
+			})
+			engine.GET("/", func(c *gin.Context) { abortWithJWTError(c, tc.err) })
+
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			var body ErrorResponse
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rec.Code)
+			} else if authenticate := rec.Header().Get("WWW-Authenticate"); authenticate != tc.expectedAuthenticate {
+				t.Errorf("Expected WWW-Authenticate '%s', got '%s'", tc.expectedAuthenticate, authenticate)
+			} else if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("Failed unmarshalling response body '%s': %+v", rec.Body.String(), err)
+			} else if body.Code != tc.expectedCode {
+				t.Errorf("Expected error code '%s', got '%s'", tc.expectedCode, body.Code)
+			} else if body.Message == "" {
+				t.Errorf("Expected error message, got none")
+			} else if accessLogReason != tc.expectedAccessLogReason {
+				t.Errorf("Expected access log reason '%s', got '%v'", tc.expectedAccessLogReason, accessLogReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package webutil
+
+import (
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/secureworks/errors"
+	"net/http"
+	"strings"
+)
+
+// AuthorizationHeaderTokenExtractor extracts tokens from "Authorization: Bearer <token>" headers. This is the default
+// extractor of the JWT middleware. Requests without an Authorization header yield no token, while requests using other
+// authentication schemes fail.
+func AuthorizationHeaderTokenExtractor() jwtmiddleware.TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			return "", nil
+		}
+		scheme, token, ok := strings.Cut(authorization, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			return "", errors.New("authorization header format must be 'Bearer <token>'")
+		}
+		return strings.TrimSpace(token), nil
+	}
+}
+
+// CookieTokenExtractor extracts tokens from the cookie with the given name. Requests without that cookie yield no
+// token.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CookieTokenExtractor(name string) jwtmiddleware.TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+}
+
+// QueryParameterTokenExtractor extracts tokens from the query parameter with the given name, for clients that cannot
+// send headers such as EventSource & WebSocket clients in browsers. The parameter is redacted in access logs (see
+// RedactAccessLogQueryParameter).
+//
+//goland:noinspection GoUnusedExportedFunction
+func QueryParameterTokenExtractor(name string) jwtmiddleware.TokenExtractor {
+	RedactAccessLogQueryParameter(name)
+	return func(r *http.Request) (string, error) {
+		return r.URL.Query().Get(name), nil
+	}
+}
+
+// WebSocketProtocolTokenExtractor extracts tokens from WebSocket handshakes offering the "bearer" subprotocol followed
+// by the token, e.g. "Sec-WebSocket-Protocol: bearer, <token>" as sent by "new WebSocket(url, ['bearer', token])" in
+// browsers. The WebSocket handler must select the "bearer" subprotocol (never the token) in its handshake response.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WebSocketProtocolTokenExtractor() jwtmiddleware.TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		var protocols []string
+		for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, protocol := range strings.Split(header, ",") {
+				protocols = append(protocols, strings.TrimSpace(protocol))
+			}
+		}
+		for i, protocol := range protocols {
+			if strings.EqualFold(protocol, "bearer") {
+				if i+1 >= len(protocols) || protocols[i+1] == "" {
+					return "", errors.New("websocket 'bearer' subprotocol must be followed by a token")
+				}
+				return protocols[i+1], nil
+			}
+		}
+		return "", nil
+	}
+}
@@ -0,0 +1,107 @@
+package webutil
+
+import (
+	"github.com/auth0/go-jwt-middleware/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type tokenExtractorTestCase struct {
+	setup         func(r *http.Request)
+	expectedToken string
+	expectedError bool
+}
+
+func testTokenExtractor(t *testing.T, extractor jwtmiddleware.TokenExtractor, testCases map[string]tokenExtractorTestCase) {
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.setup != nil {
+				tc.setup(req)
+			}
+			token, err := extractor(req)
+			if tc.expectedError && err == nil {
+				t.Errorf("Expected an error, got token '%s'", token)
+			} else if !tc.expectedError && err != nil {
+				t.Errorf("Unexpected error: %+v", err)
+			} else if token != tc.expectedToken {
+				t.Errorf("Expected token '%s', got '%s'", tc.expectedToken, token)
+			}
+		})
+	}
+}
+
+func TestAuthorizationHeaderTokenExtractor(t *testing.T) {
+	withAuthorization := func(value string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", value) }
+	}
+	testTokenExtractor(t, AuthorizationHeaderTokenExtractor(), map[string]tokenExtractorTestCase{
+		"missing":          {},
+		"bearer":           {setup: withAuthorization("Bearer abc"), expectedToken: "abc"},
+		"lowercase scheme": {setup: withAuthorization("bearer abc"), expectedToken: "abc"},
+		"other scheme":     {setup: withAuthorization("Basic amFjazpzZWNyZXQ="), expectedError: true},
+		"no token":         {setup: withAuthorization("Bearer "), expectedError: true},
+		"no scheme":        {setup: withAuthorization("abc"), expectedError: true},
+	})
+}
+
+func TestCookieTokenExtractor(t *testing.T) {
+	testTokenExtractor(t, CookieTokenExtractor("access_token"), map[string]tokenExtractorTestCase{
+		"missing":      {},
+		"other cookie": {setup: func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "abc"}) }},
+		"cookie":       {setup: func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "access_token", Value: "abc"}) }, expectedToken: "abc"},
+	})
+}
+
+func TestQueryParameterTokenExtractor(t *testing.T) {
+	withQuery := func(query string) func(r *http.Request) {
+		return func(r *http.Request) { r.URL.RawQuery = query }
+	}
+	testTokenExtractor(t, QueryParameterTokenExtractor("access_token"), map[string]tokenExtractorTestCase{
+		"missing":         {},
+		"other parameter": {setup: withQuery("token=abc")},
+		"parameter":       {setup: withQuery("a=b&access_token=abc"), expectedToken: "abc"},
+	})
+}
+
+func TestWebSocketProtocolTokenExtractor(t *testing.T) {
+	withProtocols := func(values ...string) func(r *http.Request) {
+		return func(r *http.Request) {
+			for _, value := range values {
+				r.Header.Add("Sec-WebSocket-Protocol", value)
+			}
+		}
+	}
+	testTokenExtractor(t, WebSocketProtocolTokenExtractor(), map[string]tokenExtractorTestCase{
+		"missing":          {},
+		"other protocols":  {setup: withProtocols("graphql-ws, chat")},
+		"bearer":           {setup: withProtocols("bearer, abc.def.ghi"), expectedToken: "abc.def.ghi"},
+		"bearer mixed":     {setup: withProtocols("graphql-ws, Bearer, abc"), expectedToken: "abc"},
+		"multiple headers": {setup: withProtocols("graphql-ws", "bearer", "abc"), expectedToken: "abc"},
+		"bearer last":      {setup: withProtocols("graphql-ws, bearer"), expectedError: true},
+	})
+}
+
+func TestDefaultJWTTokenExtractor(t *testing.T) {
+	extract := func(settings *jwtSettings, r *http.Request) string {
+		token, err := jwtmiddleware.MultiTokenExtractor(settings.tokenExtractors...)(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return token
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?access_token=def", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	if token := extract(newJWTSettings(), req); token != "abc" {
+		t.Errorf("Expected token 'abc' from Authorization header by default, got '%s'", token)
+	}
+	if token := extract(newJWTSettings(WithJWTTokenExtractors()), req); token != "abc" {
+		t.Errorf("Expected token 'abc' from Authorization header when no extractors given, got '%s'", token)
+	}
+	if token := extract(newJWTSettings(WithJWTTokenExtractors(QueryParameterTokenExtractor("access_token"))), req); token != "def" {
+		t.Errorf("Expected token 'def' from query parameter, got '%s'", token)
+	}
+}
@@ -0,0 +1,206 @@
+package webutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugLogHeader is the request header trusted callers use to request verbose logging of a single request (see
+// SignDebugLogHeader and CreateGinDebugLogMiddleware).
+const DebugLogHeader = "X-Debug-Log"
+
+var (
+	runtimeLogLevel  atomic.Int32
+	runtimeLogWriter atomic.Pointer[levelFilterWriter]
+
+	debugLogGlobalLevelWarning sync.Once
+)
+
+type levelFilterWriter struct {
+	out io.Writer
+}
+
+func (w *levelFilterWriter) Write(p []byte) (int, error) {
+	return w.out.Write(p)
+}
+
+func (w *levelFilterWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level != zerolog.NoLevel && level < LogLevel() {
+		return len(p), nil
+	}
+	if lw, ok := w.out.(zerolog.LevelWriter); ok {
+		return lw.WriteLevel(level, p)
+	}
+	return w.out.Write(p)
+}
+
+// InitLogging points log.Logger at the given output, filtered by the runtime log level (see SetLogLevel) instead of by
+// zerolog's global level. The global level is lowered to trace, which allows individual requests to be logged more
+// verbosely than the rest of the process (see CreateGinDebugLogMiddleware).
+//
+//goland:noinspection GoUnusedExportedFunction
+func InitLogging(output io.Writer, level zerolog.Level) {
+	writer := &levelFilterWriter{out: output}
+	runtimeLogLevel.Store(int32(level))
+	runtimeLogWriter.Store(writer)
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	log.Logger = zerolog.New(writer).With().Timestamp().Logger()
+}
+
+// SetLogLevel changes the log level of the process at runtime. If InitLogging was not called, this simply sets
+// zerolog's global level.
+func SetLogLevel(level zerolog.Level) {
+	if runtimeLogWriter.Load() != nil {
+		runtimeLogLevel.Store(int32(level))
+	} else {
+		zerolog.SetGlobalLevel(level)
+	}
+}
+
+// LogLevel returns the current log level of the process (see SetLogLevel).
+func LogLevel() zerolog.Level {
+	if runtimeLogWriter.Load() != nil {
+		return zerolog.Level(runtimeLogLevel.Load())
+	}
+	return zerolog.GlobalLevel()
+}
+
+// SignDebugLogHeader creates a DebugLogHeader value requesting the given level (debug or trace) until the given expiry,
+// signed with the given key.
+func SignDebugLogHeader(key []byte, level zerolog.Level, expiry time.Time) string {
+	payload := fmt.Sprintf("%s:%d", level, expiry.Unix())
+	return payload + ":" + signDebugLogPayload(key, payload)
+}
+
+func signDebugLogPayload(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type debugLogSettings struct {
+	signingKey []byte
+	scope      string
+	level      zerolog.Level
+}
+
+type DebugLogOption func(*debugLogSettings)
+
+// WithDebugLogSigningKey enables verbose logging of requests carrying a DebugLogHeader signed with the given key.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithDebugLogSigningKey(key []byte) DebugLogOption {
+	return func(s *debugLogSettings) { s.signingKey = key }
+}
+
+// WithDebugLogScope enables verbose logging of requests whose JWT claims carry the given scope (see HasClaimsScope).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithDebugLogScope(scope string) DebugLogOption {
+	return func(s *debugLogSettings) { s.scope = scope }
+}
+
+// WithDebugLogLevel sets the level used for requests enabled by scope (defaults to debug).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithDebugLogLevel(level zerolog.Level) DebugLogOption {
+	return func(s *debugLogSettings) { s.level = level }
+}
+
+// CreateGinDebugLogMiddleware creates a middleware that lowers the level of the request-scoped logger (created by
+// GinAccessLogMiddleware) for requests from trusted callers, regardless of the process log level. Place it after the
+// JWT middleware when enabling verbose logging by scope.
+//
+// This requires logging to be set up with InitLogging, which moves level filtering from zerolog's global level to the
+// output; otherwise the global level still suppresses the more verbose messages, and a warning is logged once.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CreateGinDebugLogMiddleware(options ...DebugLogOption) gin.HandlerFunc {
+	settings := &debugLogSettings{level: zerolog.DebugLevel}
+	for _, option := range options {
+		option(settings)
+	}
+	return func(c *gin.Context) {
+		level, ok := settings.requestedLevel(c)
+		if !ok {
+			return
+		}
+
+		ctx := c.Request.Context()
+		logger := log.Ctx(ctx)
+		if logger.GetLevel() == zerolog.Disabled {
+			return
+		}
+		if level < zerolog.GlobalLevel() {
+			debugLogGlobalLevelWarning.Do(func() {
+				log.Warn().
+					Stringer("globalLevel", zerolog.GlobalLevel()).
+					Stringer("requestedLevel", level).
+					Msg("Per-request debug logging has no effect, since zerolog's global level is higher; use InitLogging to set up logging")
+			})
+		}
+		debugLogger := logger.Level(level)
+		if writer := runtimeLogWriter.Load(); writer != nil {
+			debugLogger = debugLogger.Output(writer.out)
+		}
+		SetAccessLogField(c, "log:level:override", level.String())
+
+		c.Request = c.Request.WithContext(debugLogger.WithContext(ctx))
+		c.Next()
+		c.Request = c.Request.WithContext(ctx)
+	}
+}
+
+func (s *debugLogSettings) requestedLevel(c *gin.Context) (zerolog.Level, bool) {
+	if header := c.GetHeader(DebugLogHeader); header != "" && len(s.signingKey) > 0 {
+		if level, ok := s.verifyDebugLogHeader(header); ok {
+			return level, true
+		}
+		log.Ctx(c.Request.Context()).Warn().Str("header", DebugLogHeader).Msg("Ignoring invalid or expired debug log header")
+	}
+	if s.scope != "" && HasClaimsScope(c.Request.Context(), s.scope) {
+		return s.level, true
+	}
+	return zerolog.NoLevel, false
+}
+
+func (s *debugLogSettings) verifyDebugLogHeader(header string) (zerolog.Level, bool) {
+	separator := strings.LastIndexByte(header, ':')
+	if separator < 0 {
+		return zerolog.NoLevel, false
+	}
+	payload, signature := header[:separator], header[separator+1:]
+	if !hmac.Equal([]byte(signature), []byte(signDebugLogPayload(s.signingKey, payload))) {
+		return zerolog.NoLevel, false
+	}
+
+	levelName, expiryString, ok := strings.Cut(payload, ":")
+	if !ok {
+		return zerolog.NoLevel, false
+	} else if expiry, err := strconv.ParseInt(expiryString, 10, 64); err != nil || time.Now().Unix() > expiry {
+		return zerolog.NoLevel, false
+	} else if level, err := zerolog.ParseLevel(levelName); err != nil || (level != zerolog.DebugLevel && level != zerolog.TraceLevel) {
+		return zerolog.NoLevel, false
+	} else {
+		return level, true
+	}
+}
+
+// ginLogWriter writes gin's output to log.Logger as it is at the time of writing, so that it follows InitLogging &
+// runtime level changes. Messages are logged without a level, as they were before.
+type ginLogWriter struct{}
+
+func (w ginLogWriter) Write(p []byte) (int, error) {
+	return log.Logger.Write(p)
+}
@@ -0,0 +1,132 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initTestLogging(t *testing.T, level zerolog.Level) *bytes.Buffer {
+	t.Helper()
+	originalLogger, originalGlobalLevel := log.Logger, zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		log.Logger = originalLogger
+		zerolog.SetGlobalLevel(originalGlobalLevel)
+		runtimeLogWriter.Store(nil)
+	})
+	buffer := &bytes.Buffer{}
+	InitLogging(buffer, level)
+	return buffer
+}
+
+func TestRuntimeLogLevel(t *testing.T) {
+	buffer := initTestLogging(t, zerolog.InfoLevel)
+
+	log.Debug().Msg("hidden")
+	log.Info().Msg("shown")
+	SetLogLevel(zerolog.DebugLevel)
+	log.Debug().Msg("debug after change")
+	_, _ = ginLogWriter{}.Write([]byte("[GIN-debug] route\n"))
+	SetLogLevel(zerolog.WarnLevel)
+	log.Info().Msg("info after change")
+
+	output := buffer.String()
+	for _, expected := range []string{"shown", "debug after change", "[GIN-debug] route"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected log output to contain '%s', got: %s", expected, output)
+		}
+	}
+	for _, unexpected := range []string{"hidden", "info after change"} {
+		if strings.Contains(output, unexpected) {
+			t.Errorf("Expected log output not to contain '%s', got: %s", unexpected, output)
+		}
+	}
+	if LogLevel() != zerolog.WarnLevel {
+		t.Errorf("Expected log level warn, got %s", LogLevel())
+	}
+}
+
+func TestGinDebugLogMiddleware(t *testing.T) {
+	buffer := initTestLogging(t, zerolog.InfoLevel)
+	key := []byte("debug-signing-key")
+
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(log.Logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(GinAccessLogMiddleware)
+	engine.Use(func(c *gin.Context) {
+		// Fake JWT middleware: the bearer token is the scope string of the caller
+		if scope, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			claims := &validator.ValidatedClaims{CustomClaims: &testScopedClaims{Scope: scope}}
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), jwtmiddleware.ContextKey{}, claims))
+		}
+	})
+	engine.Use(CreateGinDebugLogMiddleware(WithDebugLogSigningKey(key), WithDebugLogScope("debug:logs")))
+	engine.GET("/", func(c *gin.Context) {
+		log.Ctx(c.Request.Context()).Debug().Msg("request debug message")
+		log.Ctx(c.Request.Context()).Trace().Msg("request trace message")
+		c.Status(http.StatusNoContent)
+	})
+
+	testCases := map[string]struct {
+		header, authorization string
+		expectDebug           bool
+		expectTrace           bool
+	}{
+		"none":             {},
+		"signed debug":     {header: SignDebugLogHeader(key, zerolog.DebugLevel, time.Now().Add(time.Minute)), expectDebug: true},
+		"signed trace":     {header: SignDebugLogHeader(key, zerolog.TraceLevel, time.Now().Add(time.Minute)), expectDebug: true, expectTrace: true},
+		"expired":          {header: SignDebugLogHeader(key, zerolog.DebugLevel, time.Now().Add(-time.Minute))},
+		"wrong key":        {header: SignDebugLogHeader([]byte("other"), zerolog.DebugLevel, time.Now().Add(time.Minute))},
+		"tampered":         {header: strings.Replace(SignDebugLogHeader(key, zerolog.DebugLevel, time.Now().Add(time.Minute)), "debug", "trace", 1)},
+		"unsupported":      {header: SignDebugLogHeader(key, zerolog.InfoLevel, time.Now().Add(time.Minute))},
+		"scope":            {authorization: "Bearer read debug:logs", expectDebug: true},
+		"scope without it": {authorization: "Bearer read"},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			buffer.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set(DebugLogHeader, tc.header)
+			}
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			engine.ServeHTTP(httptest.NewRecorder(), req)
+
+			output := buffer.String()
+			if strings.Contains(output, "request debug message") != tc.expectDebug {
+				t.Errorf("Expected debug message logged=%v, got: %s", tc.expectDebug, output)
+			}
+			if strings.Contains(output, "request trace message") != tc.expectTrace {
+				t.Errorf("Expected trace message logged=%v, got: %s", tc.expectTrace, output)
+			}
+			if strings.Contains(output, `"log:level:override"`) != tc.expectDebug {
+				t.Errorf("Expected access log override field=%v, got: %s", tc.expectDebug, output)
+			}
+			if !strings.Contains(output, "HTTP Request processed") {
+				t.Errorf("Expected access log entry, got: %s", output)
+			}
+		})
+	}
+
+	// Other requests & loggers must be unaffected
+	buffer.Reset()
+	log.Debug().Msg("process debug message")
+	if buffer.Len() > 0 {
+		t.Errorf("Expected process logger to remain at info level, got: %s", buffer.String())
+	}
+}
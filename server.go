@@ -0,0 +1,135 @@
+package webutil
+
+import (
+	"context"
+	"fmt"
+	"github.com/secureworks/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"os"
+)
+
+type HTTP2Config struct {
+	H2C                  bool   `env:"H2C" long:"h2c" description:"Accept HTTP/2 over cleartext connections (h2c) when TLS is disabled"`
+	MaxConcurrentStreams uint32 `env:"MAX_CONCURRENT_STREAMS" value-name:"COUNT" long:"max-concurrent-streams" description:"Maximum number of concurrent streams per HTTP/2 connection" default:"250"`
+	MaxReadFrameSize     uint32 `env:"MAX_READ_FRAME_SIZE" value-name:"BYTES" long:"max-read-frame-size" description:"Largest HTTP/2 frame the server is willing to read (16KiB-16MiB)" default:"1048576"`
+}
+
+func (c *HTTP2Config) Validate() error {
+	if c.MaxReadFrameSize != 0 && (c.MaxReadFrameSize < 16<<10 || c.MaxReadFrameSize > 1<<24-1) {
+		return errors.NewWithStackTrace(fmt.Sprintf("invalid HTTP/2 max read frame size %d", c.MaxReadFrameSize))
+	}
+	return nil
+}
+
+func (c *HTTP2Config) newServer() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: c.MaxConcurrentStreams,
+		MaxReadFrameSize:     c.MaxReadFrameSize,
+	}
+}
+
+// NewServer creates an HTTP server for the given handler according to this configuration. If TLS is enabled, the
+// server's certificates are reloaded on change until the given context is done; otherwise, if h2c is enabled, the
+// handler is wrapped to accept HTTP/2 over cleartext connections.
+func (c *HTTPConfig) NewServer(ctx context.Context, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", c.Port),
+		Handler: handler,
+	}
+	h2s := c.HTTP2.newServer()
+	if c.TLS.Enabled() {
+		tlsConfig, err := c.TLS.NewTLSConfig(ctx)
+		if err != nil {
+			return nil, errors.Chain(err, "failed creating TLS configuration")
+		}
+		server.TLSConfig = tlsConfig
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			return nil, errors.Chain(err, "failed configuring HTTP/2")
+		}
+	} else if c.HTTP2.H2C {
+		server.Handler = h2c.NewHandler(handler, h2s)
+	}
+	return server, nil
+}
+
+// Listen creates the listener to serve on: the inherited listener file descriptor if configured, otherwise the unix
+// socket if configured, and otherwise the TCP port.
+func (c *HTTPConfig) Listen() (net.Listener, error) {
+	if c.ListenFD > 0 {
+		f := os.NewFile(uintptr(c.ListenFD), fmt.Sprintf("listener-fd-%d", c.ListenFD))
+		if f == nil {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("invalid listener file descriptor %d", c.ListenFD))
+		}
+		defer f.Close()
+		listener, err := net.FileListener(f)
+		if err != nil {
+			return nil, errors.Chain(err, "failed using inherited listener file descriptor %d", c.ListenFD)
+		}
+		return listener, nil
+	} else if c.UnixSocket != "" {
+		// Remove stale sockets left behind by previous processes, but never other kinds of files
+		if info, err := os.Lstat(c.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(c.UnixSocket); err != nil {
+				return nil, errors.Chain(err, "failed removing stale unix socket '%s'", c.UnixSocket)
+			}
+		}
+		listener, err := net.Listen("unix", c.UnixSocket)
+		if err != nil {
+			return nil, errors.Chain(err, "failed listening on unix socket '%s'", c.UnixSocket)
+		}
+		return listener, nil
+	} else {
+		addr := fmt.Sprintf(":%d", c.Port)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, errors.Chain(err, "failed listening on '%s'", addr)
+		}
+		return listener, nil
+	}
+}
+
+// Serve serves the given handler according to this configuration until the given context is done, and then shuts
+// the server down gracefully.
+//
+//goland:noinspection GoUnusedExportedFunction
+func (c *HTTPConfig) Serve(ctx context.Context, handler http.Handler) error {
+	server, err := c.NewServer(ctx, handler)
+	if err != nil {
+		return err
+	}
+
+	listener, err := c.Listen()
+	if err != nil {
+		return err
+	}
+	return c.serve(ctx, server, listener)
+}
+
+func (c *HTTPConfig) serve(ctx context.Context, server *http.Server, listener net.Listener) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if c.TLS.Enabled() {
+			errCh <- server.ServeTLS(listener, "", "")
+		} else {
+			errCh <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return errors.Chain(err, "HTTP server failed")
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return errors.Chain(err, "failed shutting down HTTP server")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,129 @@
+package webutil
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func serveTestHTTPConfig(t *testing.T, cfg HTTPConfig) net.Listener {
+	t.Helper()
+	engine := NewGin()
+	engine.GET("/", func(c *gin.Context) { c.String(http.StatusOK, c.Request.Proto) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server, err := cfg.NewServer(ctx, engine)
+	if err != nil {
+		cancel()
+		t.Fatalf("Failed creating server: %+v", err)
+	}
+	listener, err := cfg.Listen()
+	if err != nil {
+		cancel()
+		t.Fatalf("Failed listening: %+v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- cfg.serve(ctx, server, listener) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("Server failed: %+v", err)
+		}
+	})
+	return listener
+}
+
+func assertServedProto(t *testing.T, transport http.RoundTripper, url, expectedProto string) {
+	t.Helper()
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		t.Fatalf("Failed executing request: %+v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != expectedProto {
+		t.Errorf("Expected request to be served over '%s', got '%s'", expectedProto, string(body))
+	}
+}
+
+func TestServeH2COnUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "server.sock")
+	listener := serveTestHTTPConfig(t, HTTPConfig{
+		ShutdownTimeout: time.Second,
+		UnixSocket:      socket,
+		HTTP2:           HTTP2Config{H2C: true, MaxConcurrentStreams: 10, MaxReadFrameSize: 1 << 20},
+	})
+	if listener.Addr().Network() != "unix" {
+		t.Fatalf("Expected unix socket listener, got '%s'", listener.Addr().Network())
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}
+
+	h2cTransport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}
+	assertServedProto(t, h2cTransport, "http://unix/", "HTTP/2.0")
+
+	h1Transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) { return dial(ctx) },
+	}
+	assertServedProto(t, h1Transport, "http://unix/", "HTTP/1.1")
+}
+
+func TestServeOnInheritedListener(t *testing.T) {
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed listening: %+v", err)
+	}
+	f, err := inherited.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Failed obtaining listener file: %+v", err)
+	}
+	defer f.Close()
+	_ = inherited.Close()
+
+	listener := serveTestHTTPConfig(t, HTTPConfig{ShutdownTimeout: time.Second, ListenFD: int(f.Fd())})
+	if listener.Addr().String() != inherited.Addr().String() {
+		t.Fatalf("Expected inherited listener on '%s', got '%s'", inherited.Addr(), listener.Addr())
+	}
+	assertServedProto(t, http.DefaultTransport, "http://"+listener.Addr().String()+"/", "HTTP/1.1")
+}
+
+func TestHTTPConfigServerValidation(t *testing.T) {
+	testCases := map[string]struct {
+		config HTTPConfig
+		valid  bool
+	}{
+		"defaults":             {config: HTTPConfig{Port: 8000}, valid: true},
+		"unix socket":          {config: HTTPConfig{UnixSocket: "/tmp/server.sock"}, valid: true},
+		"listener fd":          {config: HTTPConfig{ListenFD: 3}, valid: true},
+		"standard stream fd":   {config: HTTPConfig{ListenFD: 1}, valid: false},
+		"unix socket & fd":     {config: HTTPConfig{UnixSocket: "/tmp/server.sock", ListenFD: 3}, valid: false},
+		"small read frame":     {config: HTTPConfig{HTTP2: HTTP2Config{MaxReadFrameSize: 1024}}, valid: false},
+		"too large read frame": {config: HTTPConfig{HTTP2: HTTP2Config{MaxReadFrameSize: 1 << 24}}, valid: false},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if err == nil {
+				err = tc.config.HTTP2.Validate()
+			}
+			if tc.valid && err != nil {
+				t.Errorf("Expected config to be valid, got: %+v", err)
+			} else if !tc.valid && err == nil {
+				t.Errorf("Expected config to be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package webutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/secureworks/errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type TLSConfig struct {
+	CertFile     string   `env:"CERT_FILE" value-name:"PATH" long:"cert-file" description:"PEM-encoded server certificate chain file (enables TLS)"`
+	KeyFile      string   `env:"KEY_FILE" value-name:"PATH" long:"key-file" description:"PEM-encoded server private key file"`
+	MinVersion   string   `env:"MIN_VERSION" value-name:"VERSION" long:"min-version" description:"Minimum TLS version" choice:"1.2" choice:"1.3" default:"1.2"`
+	CipherSuites []string `env:"CIPHER_SUITES" value-name:"NAME" long:"cipher-suites" description:"TLS 1.2 cipher suites to allow (defaults to Go's secure cipher suites)"`
+	ClientCAFile string   `env:"CLIENT_CA_FILE" value-name:"PATH" long:"client-ca-file" description:"PEM-encoded CA bundle to verify client certificates against (enables mTLS)"`
+	ClientAuth   string   `env:"CLIENT_AUTH" value-name:"MODE" long:"client-auth" description:"Whether client certificates are required when mTLS is enabled" choice:"required" choice:"optional" default:"required"`
+}
+
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c *TLSConfig) Validate() error {
+	if !c.Enabled() {
+		if c.KeyFile != "" || c.ClientCAFile != "" {
+			return errors.New("TLS key & client CA files require a certificate file")
+		}
+		return nil
+	} else if c.KeyFile == "" {
+		return errors.New("TLS certificate file requires a key file")
+	} else if _, err := c.minVersion(); err != nil {
+		return err
+	} else if _, err := c.cipherSuites(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *TLSConfig) minVersion() (uint16, error) {
+	switch c.MinVersion {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, errors.NewWithStackTrace(fmt.Sprintf("unsupported minimum TLS version '%s'", c.MinVersion))
+	}
+}
+
+func (c *TLSConfig) cipherSuites() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range c.CipherSuites {
+		if id, ok := available[strings.TrimSpace(name)]; ok {
+			ids = append(ids, id)
+		} else {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("unsupported or insecure TLS cipher suite '%s'", name))
+		}
+	}
+	return ids, nil
+}
+
+func (c *TLSConfig) load() (*tls.Config, error) {
+	minVersion, err := c.minVersion()
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := c.cipherSuites()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, errors.Chain(err, "failed loading TLS certificate")
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, errors.Chain(err, "failed reading client CA file")
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.NewWithStackTrace(fmt.Sprintf("no certificates found in client CA file '%s'", c.ClientCAFile))
+		}
+		if c.ClientAuth == "optional" {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// NewTLSConfig creates a TLS configuration for serving, which reloads the certificate, key & client CA files whenever
+// they change until the given context is done. Failed reloads are logged and keep the current files in effect.
+func (c *TLSConfig) NewTLSConfig(ctx context.Context) (*tls.Config, error) {
+	initial, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var current atomic.Pointer[tls.Config]
+	current.Store(initial)
+
+	paths := []string{c.CertFile, c.KeyFile}
+	if c.ClientCAFile != "" {
+		paths = append(paths, c.ClientCAFile)
+	}
+	reload := func() {
+		if cfg, err := c.load(); err != nil {
+			log.Ctx(ctx).Error().Stack().Err(err).Msg("TLS configuration reload rejected")
+		} else {
+			current.Store(cfg)
+			log.Ctx(ctx).Info().Msg("TLS configuration reloaded")
+		}
+	}
+	if err := watchFiles(ctx, reload, paths...); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: initial.MinVersion,
+		NextProtos: initial.NextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &current.Load().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return current.Load(), nil
+		},
+	}, nil
+}
+
+// TLSClientCertificate returns the verified client certificate of the given request, or nil if the request was not
+// made over mTLS.
+func TLSClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// TLSClientSubject returns the subject of the verified client certificate of the given request, or an empty string
+// if the request was not made over mTLS.
+func TLSClientSubject(r *http.Request) string {
+	if cert := TLSClientCertificate(r); cert != nil {
+		return cert.Subject.String()
+	}
+	return ""
+}
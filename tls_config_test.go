@@ -0,0 +1,189 @@
+package webutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, serial int64, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed generating key: %+v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"webutil"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed creating certificate: %+v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed parsing certificate: %+v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed marshalling key: %+v", err)
+	}
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("Failed creating TLS certificate: %+v", err)
+	}
+	return cert
+}
+
+func TestTLSServing(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "Test CA", 1, nil, true)
+	serverCert := newTestCertificate(t, "server", 2, ca, false)
+	clientCert := newTestCertificate(t, "client", 3, ca, false)
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed writing '%s': %+v", name, err)
+		}
+		return path
+	}
+
+	cfg := HTTPConfig{
+		ShutdownTimeout: time.Second,
+		TLS: TLSConfig{
+			CertFile:     writeFile("server.crt", serverCert.certPEM),
+			KeyFile:      writeFile("server.key", serverCert.keyPEM),
+			MinVersion:   "1.2",
+			ClientCAFile: writeFile("ca.crt", ca.certPEM),
+			ClientAuth:   "required",
+		},
+	}
+	if err := cfg.TLS.Validate(); err != nil {
+		t.Fatalf("Expected TLS config to be valid: %+v", err)
+	}
+
+	accessLogBuffer := bytes.Buffer{}
+	logger := zerolog.New(&accessLogBuffer)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	})
+	engine.Use(GinAccessLogMiddleware)
+	engine.GET("/", func(c *gin.Context) { c.String(http.StatusOK, TLSClientSubject(c.Request)) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server, err := cfg.NewServer(ctx, engine)
+	if err != nil {
+		t.Fatalf("Failed creating server: %+v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed listening: %+v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- cfg.serve(ctx, server, listener) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("Server failed: %+v", err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certificates ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+	}
+	url := "https://" + listener.Addr().String() + "/"
+
+	// Requests without a client certificate must be rejected
+	if resp, err := newClient().Get(url); err == nil {
+		_ = resp.Body.Close()
+		t.Fatalf("Expected request without client certificate to fail, got %d", resp.StatusCode)
+	}
+
+	// Requests with a client certificate must expose its subject
+	resp, err := newClient(clientCert.tlsCertificate(t)).Get(url)
+	if err != nil {
+		t.Fatalf("Failed executing request: %+v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if expected := "CN=client,O=webutil"; string(body) != expected {
+		t.Errorf("Expected client subject '%s', got '%s'", expected, string(body))
+	} else if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("Expected server certificate serial 2, got %d", resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+	}
+	accessLog := make(map[string]interface{})
+	if err := json.Unmarshal(accessLogBuffer.Bytes(), &accessLog); err != nil {
+		t.Errorf("Failed unmarshalling access log: %+v", err)
+	} else if accessLog["tls:client:subject"] != "CN=client,O=webutil" {
+		t.Errorf("Expected access log to contain client subject, got: %+v", accessLog)
+	}
+
+	// Replacing the certificate files must be picked up by new connections
+	renewedCert := newTestCertificate(t, "server", 4, ca, false)
+	writeFile("server.key", renewedCert.keyPEM)
+	writeFile("server.crt", renewedCert.certPEM)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := newClient(clientCert.tlsCertificate(t)).Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.TLS.PeerCertificates[0].SerialNumber.Int64() == 4 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected renewed server certificate to be served")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,439 @@
+// Package webutiltest provides test helpers for services built with webutil, such as an in-process OAuth issuer that
+// lets authentication tests run offline.
+package webutiltest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/secureworks/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Algorithm is a token signing algorithm supported by Issuer.
+type Algorithm string
+
+const (
+	RS256 Algorithm = "RS256"
+	ES256 Algorithm = "ES256"
+)
+
+type issuerKey struct {
+	signer    jose.Signer
+	publicKey jose.JSONWebKey
+}
+
+// Issuer is a fake OAuth/OpenID Connect issuer, serving its OpenID configuration, JWKS, an Auth0-compatible client
+// credentials token endpoint and a RFC 7662 token introspection endpoint from an in-process TLS server. Use Domain as
+// the Auth0 domain of the JWT middleware, and Client as the HTTP client it fetches JWKS with.
+type Issuer struct {
+	t              testing.TB
+	server         *httptest.Server
+	algorithm      Algorithm
+	audience       []string
+	tokenTTL       time.Duration
+	mutex          sync.Mutex
+	keys           []*issuerKey
+	keySequence    int
+	clients        map[string]string
+	opaqueTokens   map[string]map[string]interface{}
+	unavailable    bool
+	jwksFetches    int
+	introspections int
+}
+
+// IssuerOption configures an Issuer.
+type IssuerOption func(*Issuer)
+
+// WithAlgorithm sets the algorithm tokens are signed with (RS256 by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAlgorithm(algorithm Algorithm) IssuerOption {
+	return func(i *Issuer) { i.algorithm = algorithm }
+}
+
+// WithAudience sets the default audience of minted tokens.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAudience(audience ...string) IssuerOption {
+	return func(i *Issuer) { i.audience = audience }
+}
+
+// WithTokenTTL sets the default lifetime of minted tokens (1 hour by default).
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithTokenTTL(ttl time.Duration) IssuerOption {
+	return func(i *Issuer) { i.tokenTTL = ttl }
+}
+
+// WithClient registers an OAuth client that can obtain tokens from the token endpoint using the client credentials
+// grant, and introspect tokens.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithClient(clientID, clientSecret string) IssuerOption {
+	return func(i *Issuer) { i.clients[clientID] = clientSecret }
+}
+
+// NewIssuer starts a fake issuer with a single signing key, which is stopped when the test completes. It must be called
+// from the test goroutine. The other methods of the issuer report failures using t.Errorf, and may be called from any
+// goroutine.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewIssuer(t testing.TB, options ...IssuerOption) *Issuer {
+	i := &Issuer{
+		t:            t,
+		algorithm:    RS256,
+		tokenTTL:     time.Hour,
+		clients:      make(map[string]string),
+		opaqueTokens: make(map[string]map[string]interface{}),
+	}
+	for _, option := range options {
+		option(i)
+	}
+	t.Helper()
+	if i.algorithm != RS256 && i.algorithm != ES256 {
+		t.Fatalf("Unsupported issuer signing algorithm '%s'", i.algorithm)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.handleOpenIDConfiguration)
+	mux.HandleFunc("/.well-known/jwks.json", i.handleJWKS)
+	mux.HandleFunc("/oauth/token", i.handleToken)
+	mux.HandleFunc("/oauth/introspect", i.handleIntrospection)
+	i.server = httptest.NewTLSServer(i.availability(mux))
+	t.Cleanup(i.server.Close)
+
+	if _, err := i.rotateKey(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return i
+}
+
+// URL returns the issuer URL, as found in the "iss" claim of minted tokens (e.g. "https://127.0.0.1:1234/").
+func (i *Issuer) URL() string {
+	return i.server.URL + "/"
+}
+
+// Domain returns the host & port of the issuer, for use as an Auth0 domain.
+func (i *Issuer) Domain() string {
+	return strings.TrimPrefix(i.server.URL, "https://")
+}
+
+// Client returns an HTTP client trusting the issuer's TLS certificate.
+func (i *Issuer) Client() *http.Client {
+	return i.server.Client()
+}
+
+// IntrospectionURL returns the URL of the token introspection endpoint.
+func (i *Issuer) IntrospectionURL() string {
+	return i.server.URL + "/oauth/introspect"
+}
+
+// KeyID returns the ID of the current signing key.
+func (i *Issuer) KeyID() string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.keys[len(i.keys)-1].publicKey.KeyID
+}
+
+// RotateKey generates a new signing key and returns its ID. Previous keys remain published in the JWKS until
+// RetirePreviousKeys is called, like identity providers do during key rotation.
+func (i *Issuer) RotateKey() string {
+	kid, err := i.rotateKey()
+	if err != nil {
+		i.t.Errorf("%+v", err)
+	}
+	return kid
+}
+
+func (i *Issuer) rotateKey() (string, error) {
+	var privateKey crypto.Signer
+	var err error
+	switch i.algorithm {
+	case ES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return "", errors.Chain(err, "failed generating issuer key")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.keySequence++
+	kid := fmt.Sprintf("key-%d", i.keySequence)
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(i.algorithm), Key: privateKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid),
+	)
+	if err != nil {
+		return "", errors.Chain(err, "failed creating issuer signer")
+	}
+	i.keys = append(i.keys, &issuerKey{
+		signer:    signer,
+		publicKey: jose.JSONWebKey{Key: privateKey.Public(), KeyID: kid, Algorithm: string(i.algorithm), Use: "sig"},
+	})
+	return kid, nil
+}
+
+// RetirePreviousKeys stops publishing all keys but the current signing key.
+func (i *Issuer) RetirePreviousKeys() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.keys = i.keys[len(i.keys)-1:]
+}
+
+// SetUnavailable makes all issuer endpoints respond with 503 Service Unavailable, to simulate outages.
+func (i *Issuer) SetUnavailable(unavailable bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.unavailable = unavailable
+}
+
+// JWKSFetches returns the number of successful JWKS requests served so far.
+func (i *Issuer) JWKSFetches() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.jwksFetches
+}
+
+// Introspections returns the number of successful token introspection requests served so far.
+func (i *Issuer) Introspections() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.introspections
+}
+
+// MintToken returns a token signed by the current signing key, carrying the given claims. Unless overridden, the
+// "iss", "iat" & "exp" claims are set according to the issuer configuration, as is "aud" if a default audience was
+// configured. Claims with nil values are omitted, e.g. to mint tokens without an expiry.
+func (i *Issuer) MintToken(claims map[string]interface{}) string {
+	token, err := i.mintToken(claims)
+	if err != nil {
+		i.t.Errorf("%+v", err)
+	}
+	return token
+}
+
+func (i *Issuer) mintToken(claims map[string]interface{}) (string, error) {
+	allClaims := i.tokenClaims(claims)
+
+	i.mutex.Lock()
+	signer := i.keys[len(i.keys)-1].signer
+	i.mutex.Unlock()
+
+	token, err := jwt.Signed(signer).Claims(allClaims).CompactSerialize()
+	if err != nil {
+		return "", errors.Chain(err, "failed minting token")
+	}
+	return token, nil
+}
+
+// MintOpaqueToken returns a random opaque token, whose claims are only available via the token introspection endpoint.
+// Claims are defaulted the same way as MintToken does.
+func (i *Issuer) MintOpaqueToken(claims map[string]interface{}) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		i.t.Errorf("Failed generating opaque token: %+v", err)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.opaqueTokens[token] = i.tokenClaims(claims)
+	return token
+}
+
+// RevokeToken makes the given opaque token inactive.
+func (i *Issuer) RevokeToken(token string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.opaqueTokens, token)
+}
+
+func (i *Issuer) tokenClaims(claims map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	allClaims := map[string]interface{}{
+		"iss": i.URL(),
+		"iat": now.Unix(),
+		"exp": now.Add(i.tokenTTL).Unix(),
+	}
+	if len(i.audience) > 0 {
+		allClaims["aud"] = i.audience
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(allClaims, name)
+		} else {
+			allClaims[name] = value
+		}
+	}
+	return allClaims
+}
+
+func (i *Issuer) availability(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.mutex.Lock()
+		unavailable := i.unavailable
+		i.mutex.Unlock()
+		if unavailable {
+			http.Error(w, "issuer unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (i *Issuer) handleOpenIDConfiguration(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL(),
+		"jwks_uri":                              i.server.URL + "/.well-known/jwks.json",
+		"token_endpoint":                        i.server.URL + "/oauth/token",
+		"introspection_endpoint":                i.IntrospectionURL(),
+		"grant_types_supported":                 []string{"client_credentials"},
+		"id_token_signing_alg_values_supported": []string{string(i.algorithm)},
+	})
+}
+
+func (i *Issuer) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	i.mutex.Lock()
+	keySet := jose.JSONWebKeySet{}
+	for _, key := range i.keys {
+		keySet.Keys = append(keySet.Keys, key.publicKey)
+	}
+	i.jwksFetches++
+	i.mutex.Unlock()
+	writeJSON(w, http.StatusOK, keySet)
+}
+
+// handleToken implements the client credentials grant the way Auth0 does, accepting JSON or form-encoded requests.
+func (i *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	var req struct {
+		GrantType    string `json:"grant_type"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		Audience     string `json:"audience"`
+		Scope        string `json:"scope"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+			return
+		}
+	} else {
+		req.GrantType, req.ClientID, req.ClientSecret = r.PostFormValue("grant_type"), r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+		req.Audience, req.Scope = r.PostFormValue("audience"), r.PostFormValue("scope")
+	}
+
+	i.mutex.Lock()
+	secret, ok := i.clients[req.ClientID]
+	i.mutex.Unlock()
+	if req.GrantType != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	} else if !ok || secret != req.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	claims := map[string]interface{}{
+		"sub": req.ClientID + "@clients",
+		"azp": req.ClientID,
+		"gty": "client-credentials",
+	}
+	if req.Audience != "" {
+		claims["aud"] = req.Audience
+	}
+	if req.Scope != "" {
+		claims["scope"] = req.Scope
+	}
+	token, err := i.mintToken(claims)
+	if err != nil {
+		i.t.Errorf("%+v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(i.tokenTTL.Seconds()),
+	})
+}
+
+// handleIntrospection implements RFC 7662 token introspection of opaque tokens, requiring registered client
+// credentials via HTTP basic authentication or the request form.
+func (i *Issuer) handleIntrospection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "invalid_request"})
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if secret, ok := i.clients[clientID]; !ok || secret != clientSecret {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	i.introspections++
+
+	claims, ok := i.opaqueTokens[r.PostFormValue("token")]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	} else if exp, ok := unixTime(claims["exp"]); ok && time.Now().Unix() >= exp {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+	res := map[string]interface{}{"active": true, "token_type": "Bearer"}
+	for name, value := range claims {
+		res[name] = value
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func unixTime(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
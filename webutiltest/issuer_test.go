@@ -0,0 +1,190 @@
+package webutiltest
+
+import (
+	"encoding/json"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fetchJSON(t *testing.T, client *http.Client, url string, target interface{}) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Failed fetching '%s': %+v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d from '%s', got %d", http.StatusOK, url, resp.StatusCode)
+	} else if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		t.Fatalf("Failed decoding '%s': %+v", url, err)
+	}
+}
+
+func verifyToken(t *testing.T, issuer *Issuer, token string) map[string]interface{} {
+	t.Helper()
+	var configuration struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	fetchJSON(t, issuer.Client(), issuer.URL()+".well-known/openid-configuration", &configuration)
+	if configuration.Issuer != issuer.URL() {
+		t.Fatalf("Expected issuer '%s', got '%s'", issuer.URL(), configuration.Issuer)
+	}
+	var keySet jose.JSONWebKeySet
+	fetchJSON(t, issuer.Client(), configuration.JWKSURI, &keySet)
+
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("Failed parsing token: %+v", err)
+	}
+	keys := keySet.Key(parsed.Headers[0].KeyID)
+	if len(keys) != 1 {
+		t.Fatalf("Expected JWKS to contain key '%s', got: %+v", parsed.Headers[0].KeyID, keySet)
+	}
+	claims := make(map[string]interface{})
+	if err := parsed.Claims(keys[0].Key, &claims); err != nil {
+		t.Fatalf("Failed verifying token: %+v", err)
+	}
+	return claims
+}
+
+func TestIssuerMintToken(t *testing.T) {
+	for _, algorithm := range []Algorithm{RS256, ES256} {
+		algorithm := algorithm
+		t.Run(string(algorithm), func(t *testing.T) {
+			issuer := NewIssuer(t, WithAlgorithm(algorithm), WithAudience("https://api.example.invalid"))
+			token := issuer.MintToken(map[string]interface{}{"sub": "user", "scope": "read", "iat": nil})
+			if parsed, err := jwt.ParseSigned(token); err != nil {
+				t.Fatalf("Failed parsing token: %+v", err)
+			} else if parsed.Headers[0].Algorithm != string(algorithm) {
+				t.Errorf("Expected algorithm '%s', got '%s'", algorithm, parsed.Headers[0].Algorithm)
+			}
+
+			claims := verifyToken(t, issuer, token)
+			if claims["iss"] != issuer.URL() {
+				t.Errorf("Expected issuer '%s', got '%v'", issuer.URL(), claims["iss"])
+			} else if claims["sub"] != "user" || claims["scope"] != "read" {
+				t.Errorf("Expected given claims, got: %+v", claims)
+			} else if aud, ok := claims["aud"].([]interface{}); !ok || len(aud) != 1 || aud[0] != "https://api.example.invalid" {
+				t.Errorf("Expected default audience, got: %+v", claims["aud"])
+			} else if _, ok := claims["exp"]; !ok {
+				t.Errorf("Expected default expiry, got: %+v", claims)
+			} else if _, ok := claims["iat"]; ok {
+				t.Errorf("Expected 'iat' claim to be omitted, got: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestIssuerKeyRotation(t *testing.T) {
+	issuer := NewIssuer(t, WithAlgorithm(ES256))
+	oldKeyID := issuer.KeyID()
+	oldToken := issuer.MintToken(nil)
+
+	newKeyID := issuer.RotateKey()
+	if newKeyID == oldKeyID || issuer.KeyID() != newKeyID {
+		t.Fatalf("Expected rotation to switch signing key from '%s', got '%s'", oldKeyID, issuer.KeyID())
+	}
+	newToken := issuer.MintToken(nil)
+	verifyToken(t, issuer, oldToken)
+	verifyToken(t, issuer, newToken)
+
+	issuer.RetirePreviousKeys()
+	var keySet jose.JSONWebKeySet
+	fetchJSON(t, issuer.Client(), issuer.URL()+".well-known/jwks.json", &keySet)
+	if len(keySet.Keys) != 1 || keySet.Keys[0].KeyID != newKeyID {
+		t.Errorf("Expected only key '%s' to remain published, got: %+v", newKeyID, keySet)
+	}
+	if fetches := issuer.JWKSFetches(); fetches != 3 {
+		t.Errorf("Expected 3 JWKS fetches, got %d", fetches)
+	}
+}
+
+func TestIssuerClientCredentials(t *testing.T) {
+	issuer := NewIssuer(t, WithClient("client", "secret"))
+	requestToken := func(secret string) *http.Response {
+		resp, err := issuer.Client().PostForm(issuer.URL()+"oauth/token", url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {"client"},
+			"client_secret": {secret},
+			"audience":      {"https://api.example.invalid"},
+		})
+		if err != nil {
+			t.Fatalf("Failed requesting token: %+v", err)
+		}
+		return resp
+	}
+
+	if resp := requestToken("wrong"); resp.Body.Close() != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong client secret, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp := requestToken("secret")
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed decoding token response: %+v", err)
+	} else if !strings.EqualFold(body.TokenType, "Bearer") {
+		t.Errorf("Expected bearer token type, got '%s'", body.TokenType)
+	}
+	claims := verifyToken(t, issuer, body.AccessToken)
+	if claims["sub"] != "client@clients" || claims["aud"] != "https://api.example.invalid" {
+		t.Errorf("Expected client credentials claims, got: %+v", claims)
+	}
+
+	issuer.SetUnavailable(true)
+	if resp, err := issuer.Client().Get(issuer.URL() + ".well-known/jwks.json"); err != nil {
+		t.Fatalf("Failed fetching JWKS: %+v", err)
+	} else if _ = resp.Body.Close(); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d from unavailable issuer, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestIssuerIntrospection(t *testing.T) {
+	issuer := NewIssuer(t, WithClient("client", "secret"), WithAudience("https://api.example.invalid"))
+	introspect := func(clientSecret, token string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, issuer.IntrospectionURL(), strings.NewReader(url.Values{"token": {token}}.Encode()))
+		if err != nil {
+			t.Fatalf("Failed creating request: %+v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("client", clientSecret)
+		resp, err := issuer.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed introspecting token: %+v", err)
+		}
+		defer resp.Body.Close()
+		body := make(map[string]interface{})
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed decoding introspection response: %+v", err)
+		}
+		return resp.StatusCode, body
+	}
+
+	token := issuer.MintOpaqueToken(map[string]interface{}{"sub": "user", "scope": "read"})
+	if status, _ := introspect("wrong", token); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong client secret, got %d", http.StatusUnauthorized, status)
+	}
+	if _, body := introspect("secret", token); body["active"] != true || body["sub"] != "user" || body["scope"] != "read" {
+		t.Errorf("Expected active token with claims, got: %+v", body)
+	}
+	expiredToken := issuer.MintOpaqueToken(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})
+	if _, body := introspect("secret", expiredToken); body["active"] != false {
+		t.Errorf("Expected expired token to be inactive, got: %+v", body)
+	}
+	issuer.RevokeToken(token)
+	if _, body := introspect("secret", token); body["active"] != false || len(body) != 1 {
+		t.Errorf("Expected revoked token to be inactive without claims, got: %+v", body)
+	}
+	if introspections := issuer.Introspections(); introspections != 3 {
+		t.Errorf("Expected 3 introspections, got %d", introspections)
+	}
+}